@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	allowSources      = listFlag("allow-sources", "", "Tailnet users, nodes or tags allowed to use the proxy (comma-separated, may be repeated; e.g. alice@example.com,laptop,tag:trusted); all sources are allowed if empty")
+	sourcePolicyRules = listFlag("source-policies", "", "Destinations that particular tailnet sources are limited to (comma-separated source=prefix[:ports], may be repeated; e.g. tag:kids=203.0.113.0/24:443)")
+)
+
+// IdentityResolver looks up the tailnet identity behind an address
+type IdentityResolver interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// sourceList is a list of tailnet identities: tags if they start with "tag:",
+// users if they contain an "@", and node names otherwise
+type sourceList []string
+
+// parseSourceList parses a comma-separated list of tailnet identities
+func parseSourceList(sources string) (sourceList, error) {
+	var res sourceList
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if err := checkSource(source); err != nil {
+			return nil, err
+		}
+		res = append(res, source)
+	}
+	return res, nil
+}
+
+// checkSource returns an error if source is a malformed tag
+func checkSource(source string) error {
+	if strings.HasPrefix(source, "tag:") {
+		if err := tailcfg.CheckTag(source); err != nil {
+			return fmt.Errorf("invalid source %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// destination is a range of addresses and ports
+type destination struct {
+	prefix  netip.Prefix
+	minPort uint16
+	maxPort uint16
+}
+
+// contains returns whether dst is within the range
+func (d destination) contains(dst netip.AddrPort) bool {
+	return d.prefix.Contains(dst.Addr().Unmap()) && dst.Port() >= d.minPort && dst.Port() <= d.maxPort
+}
+
+// sourcePolicy permits a tailnet source to connect to a range of destinations
+type sourcePolicy struct {
+	source string
+	destination
+}
+
+// sourcePolicies limits the destinations that particular sources may connect
+// to. Sources without any policies are unrestricted.
+type sourcePolicies []sourcePolicy
+
+// parseSourcePolicies parses a comma-separated list of source=destination
+// pairs. Destinations are CIDR prefixes or IP addresses, optionally followed by
+// a port or port range (e.g. 203.0.113.0/24:443, [2001:db8::1]:8000-8999).
+func parseSourcePolicies(s string) (sourcePolicies, error) {
+	var res sourcePolicies
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		source, destination, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid policy %s: expected source=destination", entry)
+		}
+
+		source = strings.TrimSpace(source)
+		if source == "" {
+			return nil, fmt.Errorf("invalid policy %s: missing source", entry)
+		}
+		if err := checkSource(source); err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %w", entry, err)
+		}
+
+		dest, err := parseDestination(strings.TrimSpace(destination))
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %w", entry, err)
+		}
+		res = append(res, sourcePolicy{source: source, destination: dest})
+	}
+	return res, nil
+}
+
+// parseDestination parses a prefix or address with an optional port range
+func parseDestination(s string) (destination, error) {
+	dest := destination{maxPort: 65535}
+
+	var ports string
+	if addr, bits, ok := strings.Cut(s, "/"); ok {
+		// Anything after the prefix length is a port range.
+		bits, ports, _ = strings.Cut(bits, ":")
+		s = addr + "/" + bits
+	} else if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		s = addrPort.Addr().String()
+		ports = strconv.Itoa(int(addrPort.Port()))
+	} else if strings.HasPrefix(s, "[") {
+		// A bracketed IPv6 address with a port range rather than a single port.
+		addr, rest, ok := strings.Cut(strings.TrimPrefix(s, "["), "]:")
+		if !ok {
+			return destination{}, fmt.Errorf("invalid destination %s", s)
+		}
+		s, ports = addr, rest
+	} else if addr, rest, ok := strings.Cut(s, ":"); ok && !strings.Contains(rest, ":") {
+		s, ports = addr, rest
+	}
+
+	prefix, err := parsePrefixOrAddr(s)
+	if err != nil {
+		return destination{}, err
+	}
+	dest.prefix = prefix
+
+	if ports != "" {
+		low, high, isRange := strings.Cut(ports, "-")
+		minPort, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return destination{}, fmt.Errorf("invalid port %s", low)
+		}
+		maxPort := minPort
+		if isRange {
+			if maxPort, err = strconv.ParseUint(high, 10, 16); err != nil || maxPort < minPort {
+				return destination{}, fmt.Errorf("invalid port range %s", ports)
+			}
+		}
+		dest.minPort, dest.maxPort = uint16(minPort), uint16(maxPort)
+	}
+
+	return dest, nil
+}
+
+// restricts returns whether any policies apply to the identity
+func (p sourcePolicies) restricts(who *apitype.WhoIsResponse) bool {
+	for _, policy := range p {
+		if matchesSource(who, policy.source) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits returns whether the identity may connect to dst. Identities that
+// have no policies may connect anywhere.
+func (p sourcePolicies) permits(who *apitype.WhoIsResponse, dst netip.AddrPort) bool {
+	if !p.restricts(who) {
+		return true
+	}
+
+	for _, policy := range p {
+		if matchesSource(who, policy.source) && policy.contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether the identity matches any of the sources
+func (s sourceList) matches(who *apitype.WhoIsResponse) bool {
+	for _, source := range s {
+		if matchesSource(who, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSource returns whether the identity is the given tag, user or node
+func matchesSource(who *apitype.WhoIsResponse, source string) bool {
+	switch {
+	case strings.HasPrefix(source, "tag:"):
+		return who.Node != nil && containsFold(who.Node.Tags, source)
+	case strings.Contains(source, "@"):
+		// Tagged nodes report a placeholder user, so only match users
+		// against untagged nodes.
+		return who.UserProfile != nil && (who.Node == nil || len(who.Node.Tags) == 0) && strings.EqualFold(who.UserProfile.LoginName, source)
+	default:
+		return who.Node != nil && matchesNodeName(who.Node, source)
+	}
+}
+
+// matchesNodeName returns whether name is the node's short name or its FQDN
+func matchesNodeName(node *tailcfg.Node, name string) bool {
+	fqdn := strings.TrimSuffix(node.Name, ".")
+	name = strings.TrimSuffix(name, ".")
+	return strings.EqualFold(node.ComputedName, name) ||
+		strings.EqualFold(fqdn, name) ||
+		strings.EqualFold(strings.Split(fqdn, ".")[0], name)
+}
+
+// containsFold returns whether values contains value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeIdentity returns a short description of a tailnet identity for logging
+func describeIdentity(who *apitype.WhoIsResponse) string {
+	if who.Node == nil {
+		return "unknown"
+	}
+	if len(who.Node.Tags) > 0 {
+		return fmt.Sprintf("%s (%s)", who.Node.ComputedName, strings.Join(who.Node.Tags, ","))
+	}
+	if who.UserProfile != nil {
+		return fmt.Sprintf("%s (%s)", who.Node.ComputedName, who.UserProfile.LoginName)
+	}
+	return who.Node.ComputedName
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestSourceListMatches(t *testing.T) {
+	sources, err := parseSourceList("alice@example.com, laptop, tag:trusted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		who  *apitype.WhoIsResponse
+		want bool
+	}{
+		{
+			name: "allowed user",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ComputedName: "phone", Name: "phone.tail1234.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "Alice@example.com"},
+			},
+			want: true,
+		},
+		{
+			name: "allowed node",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ComputedName: "laptop", Name: "laptop.tail1234.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+			},
+			want: true,
+		},
+		{
+			name: "allowed tag",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ComputedName: "server", Name: "server.tail1234.ts.net.", Tags: []string{"tag:trusted"}},
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+			},
+			want: true,
+		},
+		{
+			name: "tagged node owned by allowed user",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ComputedName: "server", Name: "server.tail1234.ts.net.", Tags: []string{"tag:other"}},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+			},
+			want: false,
+		},
+		{
+			name: "unknown user",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ComputedName: "desktop", Name: "desktop.tail1234.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+			},
+			want: false,
+		},
+		{
+			name: "no node",
+			who:  &apitype.WhoIsResponse{},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sources.matches(tt.who); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSourceList(t *testing.T) {
+	if _, err := parseSourceList("tag:"); err == nil {
+		t.Error("expected an error for an invalid tag")
+	}
+}
+
+func TestSourcePolicies(t *testing.T) {
+	policies, err := parseSourcePolicies("tag:kids=203.0.113.0/24:443, tag:kids=198.51.100.7:8000-8999, laptop=2001:db8::/32, laptop=[2001:db9::1]:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kids := &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "tablet", Tags: []string{"tag:kids"}}}
+	laptop := &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "laptop"}}
+	other := &apitype.WhoIsResponse{Node: &tailcfg.Node{ComputedName: "desktop"}}
+
+	tests := []struct {
+		name string
+		who  *apitype.WhoIsResponse
+		dst  string
+		want bool
+	}{
+		{"permitted prefix and port", kids, "203.0.113.10:443", true},
+		{"permitted prefix, other port", kids, "203.0.113.10:80", false},
+		{"permitted port range", kids, "198.51.100.7:8080", true},
+		{"outside port range", kids, "198.51.100.7:9000", false},
+		{"other destination", kids, "192.0.2.1:443", false},
+		{"mapped address", kids, "[::ffff:203.0.113.10]:443", true},
+		{"any port", laptop, "[2001:db8::1]:1234", true},
+		{"bracketed address and port", laptop, "[2001:db9::1]:22", true},
+		{"bracketed address, other port", laptop, "[2001:db9::1]:23", false},
+		{"unrestricted source", other, "192.0.2.1:443", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policies.permits(tt.who, netip.MustParseAddrPort(tt.dst)); got != tt.want {
+				t.Errorf("permits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSourcePolicies(t *testing.T) {
+	invalid := []string{
+		"tag:kids",
+		"=203.0.113.0/24",
+		"tag:=203.0.113.0/24",
+		"tag:kids=bogus",
+		"tag:kids=203.0.113.0/24:http",
+		"tag:kids=203.0.113.0/24:443-80",
+		"tag:kids=203.0.113.0/24:70000",
+	}
+	for _, policy := range invalid {
+		if _, err := parseSourcePolicies(policy); err == nil {
+			t.Errorf("parseSourcePolicies(%q) expected an error", policy)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	adminAddress = flag.String("admin-address", "", "Address on the node's Tailscale IPs to serve the admin API on (e.g. :8080; disabled if empty)")
+	adminTLS     = flag.Bool("admin-tls", false, "Serve the admin API over HTTPS using the node's tailnet certificate (HTTPS must be enabled for the tailnet)")
+	adminSources = listFlag("admin-sources", "", "Tailnet users, nodes or tags allowed to use the admin API (comma-separated, may be repeated; e.g. alice@example.com,tag:admin)")
+)
+
+// ServeAdmin serves the control interface over HTTP on a tailnet listener
+// until ctx is cancelled. Only requests from the given sources are allowed.
+func (c *ControlServer) ServeAdmin(ctx context.Context, listener net.Listener, identities IdentityResolver, allowed sourceList) error {
+	server := &http.Server{
+		Handler:           requireSources(identities, allowed, c.handler()),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	slog.Info("Serving admin API on the tailnet", "address", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// requireSources wraps next so that it only handles requests from the
+// allowed tailnet sources
+func requireSources(identities IdentityResolver, allowed sourceList, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, err := identities.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			slog.Warn("Rejecting admin request from unknown source", "source", r.RemoteAddr, "error", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if !allowed.matches(who) {
+			slog.Warn("Rejecting admin request from source that isn't allowed", "source", r.RemoteAddr, "identity", describeIdentity(who))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
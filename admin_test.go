@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+type fakeIdentities map[string]*apitype.WhoIsResponse
+
+func (f fakeIdentities) WhoIs(_ context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if who, ok := f[remoteAddr]; ok {
+		return who, nil
+	}
+	return nil, errors.New("no such peer")
+}
+
+func TestRequireSources(t *testing.T) {
+	identities := fakeIdentities{
+		"100.64.0.2:1234": {Node: &tailcfg.Node{ComputedName: "laptop"}, UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}},
+		"100.64.0.3:1234": {Node: &tailcfg.Node{ComputedName: "phone"}, UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"}},
+	}
+	handler := requireSources(identities, sourceList{"alice@example.com"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		remote string
+		want   int
+	}{
+		{"allowed source", "100.64.0.2:1234", http.StatusNoContent},
+		{"other source", "100.64.0.3:1234", http.StatusForbidden},
+		{"unknown source", "100.64.0.4:1234", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/status", nil)
+			req.RemoteAddr = tt.remote
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
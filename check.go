@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// CheckConfig validates all flags and settings as far as possible without
+// starting the Tailscale node or the upstream, and reports every problem
+// found. WireGuard endpoints are resolved, and SSH keys are read.
+func CheckConfig() error {
+	errs := []error{validateFlags()}
+
+	switch *upstream {
+	case "wireguard":
+		cfg := wireGuardConfigFromFlags()
+		if *wgProvider != "" {
+			// Pick a server to check the provider's API is reachable, but
+			// don't register the key with the account until we run
+			server, err := selectProviderServer()
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			cfg.PeerPublicKey = server.PublicKey
+			cfg.Endpoint = server.Endpoint
+		}
+
+		errs = append(errs, cfg.validate())
+		if _, err := parseRotationServers(*wgRotationServers, cfg.PeerPublicKey, cfg.PresharedKey); err != nil {
+			errs = append(errs, err)
+		}
+	case "ssh":
+		if _, err := sshClientConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := parsePrefixDurations(*dialTimeoutOverrides); err != nil {
+		errs = append(errs, fmt.Errorf("invalid dial timeout overrides: %w", err))
+	}
+	if _, err := parsePrefixDurations(*maxLifetimeOverrides); err != nil {
+		errs = append(errs, fmt.Errorf("invalid max lifetime overrides: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// selectProviderServer picks a server from the configured VPN provider
+func selectProviderServer() (wireGuardServer, error) {
+	provider, err := NewProvider()
+	if err != nil {
+		return wireGuardServer{}, err
+	}
+	return provider.SelectServer(context.Background())
+}
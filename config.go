@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+var (
+	configFile    = flag.String("config", "", "Path to a YAML or TOML config file (flags and environment variables take precedence over its values)")
+	configProfile = flag.String("profile", "", "Name of a profile in the config file to apply over the rest of its settings")
+)
+
+// configValue is a single setting read from a config file
+type configValue struct {
+	key      []string
+	value    string
+	position string
+}
+
+// applyConfigFile reads settings from the config file at path and applies
+// them to any flags in fs that haven't already been set. Keys are flag names,
+// and may be nested (e.g. `wg: {endpoint: ...}` sets --wg-endpoint). Settings
+// under `profiles.<name>` override the rest of the file when the profile flag
+// in fs (or failing that, in the file) selects that profile.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values []configValue
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		values, err = parseTOMLConfig(path, data)
+	default:
+		values, err = parseYAMLConfig(path, data)
+	}
+	if err != nil && values == nil {
+		return err
+	}
+
+	// Any problems with individual settings are reported along with the rest
+	errs := []error{err}
+
+	values, err = selectProfile(fs, values)
+	if err != nil {
+		return err
+	}
+
+	alreadySet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		alreadySet[f.Name] = true
+	})
+
+	for _, v := range values {
+		f := lookupConfigFlag(fs, v.key)
+		if f == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", v.position, strings.Join(v.key, ".")))
+			continue
+		}
+
+		if alreadySet[f.Name] {
+			continue
+		}
+
+		if err := fs.Set(f.Name, v.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value for %s: %w", v.position, f.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selectProfile returns the settings from values that apply to the selected
+// profile: those outside `profiles`, with any also set by the profile replaced
+// by the profile's value. Settings for other profiles are dropped.
+func selectProfile(fs *flag.FlagSet, values []configValue) ([]configValue, error) {
+	var profile string
+	if f := fs.Lookup("profile"); f != nil {
+		profile = f.Value.String()
+		if profile == "" {
+			for _, v := range values {
+				if len(v.key) == 1 && v.key[0] == "profile" {
+					profile = v.value
+				}
+			}
+		}
+	}
+
+	var res, overrides []configValue
+	found := false
+	for _, v := range values {
+		if v.key[0] != "profiles" {
+			res = append(res, v)
+			continue
+		}
+		if len(v.key) < 3 {
+			return nil, fmt.Errorf("%s: profiles must be maps of settings", v.position)
+		}
+		if v.key[1] == profile {
+			found = true
+			overrides = append(overrides, configValue{key: v.key[2:], value: v.value, position: v.position})
+		}
+	}
+	if profile != "" && !found {
+		return nil, fmt.Errorf("profile %q not found in config file", profile)
+	}
+
+	for _, override := range overrides {
+		f := lookupConfigFlag(fs, override.key)
+		res = slices.DeleteFunc(res, func(v configValue) bool {
+			if f == nil {
+				return slices.Equal(v.key, override.key)
+			}
+			return lookupConfigFlag(fs, v.key) == f
+		})
+	}
+	return append(res, overrides...), nil
+}
+
+// lookupConfigFlag finds the flag corresponding to a (possibly nested) key
+func lookupConfigFlag(fs *flag.FlagSet, key []string) *flag.Flag {
+	if f := fs.Lookup(strings.Join(key, "-")); f != nil {
+		return f
+	}
+	return fs.Lookup(strings.Join(key, "."))
+}
+
+// parseYAMLConfig flattens a YAML document into a list of settings
+func parseYAMLConfig(path string, data []byte) ([]configValue, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	var values []configValue
+	var errs []error
+	var walk func(prefix []string, node *yaml.Node)
+	walk = func(prefix []string, node *yaml.Node) {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			key := append(append([]string{}, prefix...), keyNode.Value)
+			position := fmt.Sprintf("%s:%d", path, keyNode.Line)
+
+			switch valueNode.Kind {
+			case yaml.MappingNode:
+				walk(key, valueNode)
+			case yaml.SequenceNode:
+				var items []string
+				for _, item := range valueNode.Content {
+					if item.Kind != yaml.ScalarNode {
+						errs = append(errs, fmt.Errorf("%s:%d: lists may only contain simple values", path, item.Line))
+						continue
+					}
+					items = append(items, item.Value)
+				}
+				values = append(values, configValue{key: key, value: strings.Join(items, ","), position: position})
+			case yaml.ScalarNode:
+				values = append(values, configValue{key: key, value: valueNode.Value, position: position})
+			default:
+				errs = append(errs, fmt.Errorf("%s: unsupported value for %s", position, strings.Join(key, ".")))
+			}
+		}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: config file must contain a map of settings", path, root.Line)
+	}
+	walk(nil, root)
+
+	return values, errors.Join(errs...)
+}
+
+// parseTOMLConfig flattens a TOML document into a list of settings
+func parseTOMLConfig(path string, data []byte) ([]configValue, error) {
+	var doc map[string]any
+	md, err := toml.Decode(string(data), &doc)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("%s:%d: failed to parse config file: %s", path, parseErr.Position.Line, parseErr.Message)
+		}
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	lines := tomlKeyLines(data)
+	position := func(key toml.Key) string {
+		for i := len(key); i > 0; i-- {
+			if line, ok := lines[strings.Join(key[:i], ".")]; ok {
+				return fmt.Sprintf("%s:%d", path, line)
+			}
+		}
+		return path
+	}
+
+	var values []configValue
+	var errs []error
+	reported := make(map[string]bool)
+	for _, key := range md.Keys() {
+		switch md.Type(key...) {
+		case "Hash":
+			// Tables are flattened into the keys within them, which follow
+			continue
+		case "ArrayHash":
+			// Each table in the array repeats the key, but it only needs
+			// reporting once
+			if name := strings.Join(key, "."); !reported[name] {
+				reported[name] = true
+				errs = append(errs, fmt.Errorf("%s: lists may only contain simple values (%s)", position(key), name))
+			}
+			continue
+		}
+
+		value, ok := tomlLookup(doc, key)
+		if !ok {
+			// Keys within an array of tables, which has already been reported
+			continue
+		}
+		if items, ok := value.([]any); ok {
+			var parts []string
+			for _, item := range items {
+				switch item.(type) {
+				case map[string]any, []any:
+					errs = append(errs, fmt.Errorf("%s: lists may only contain simple values (%s)", position(key), strings.Join(key, ".")))
+					continue
+				}
+				parts = append(parts, fmt.Sprint(item))
+			}
+			value = strings.Join(parts, ",")
+		}
+		values = append(values, configValue{key: key, value: fmt.Sprint(value), position: position(key)})
+	}
+
+	return values, errors.Join(errs...)
+}
+
+// tomlLookup finds the value of a (possibly nested) key in a decoded document
+func tomlLookup(doc map[string]any, key toml.Key) (any, bool) {
+	var value any = doc
+	for _, k := range key {
+		table, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = table[k]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// tomlKeyLines finds the line each key and table in a TOML document is
+// defined on, keyed by the dotted path to it. The decoder doesn't expose
+// positions, so this is a simple line-based scan; keys it can't place (such
+// as those within inline tables) fall back to the line of their parent.
+func tomlKeyLines(data []byte) map[string]int {
+	res := make(map[string]int)
+	var table []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			end := strings.Index(line, "]")
+			if end == -1 {
+				continue
+			}
+			table = splitTOMLKey(strings.Trim(line[:end], "[ \t"))
+			if _, ok := res[strings.Join(table, ".")]; !ok {
+				res[strings.Join(table, ".")] = i + 1
+			}
+		default:
+			name, _, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			key := strings.Join(append(slices.Clone(table), splitTOMLKey(name)...), ".")
+			if _, ok := res[key]; !ok {
+				res[key] = i + 1
+			}
+		}
+	}
+	return res
+}
+
+// splitTOMLKey splits a dotted TOML key into its parts, removing any quotes
+func splitTOMLKey(key string) []string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return parts
+}
+
+// effectiveValue is a flag's value along with where it came from
+type effectiveValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// dumpConfig writes the value of every flag in fs as JSON, noting whether
+// each came from the command line or environment (those in explicit), a file,
+// or the default. Secrets are redacted.
+func dumpConfig(w io.Writer, fs *flag.FlagSet, explicit map[string]bool) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	res := make(map[string]effectiveValue)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := effectiveValue{Value: f.Value.String(), Source: "default"}
+		switch {
+		case explicit[f.Name]:
+			v.Source = "flag or environment"
+		case isSecretFileSet(fs, f.Name):
+			v.Source = "secret file"
+		case set[f.Name]:
+			v.Source = "config file"
+		}
+		if isSecretFlag(f.Name) && v.Value != "" {
+			v.Value = "REDACTED"
+		}
+		res[f.Name] = v
+	})
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(res)
+}
+
+// listValue is a comma-separated list flag that may also be given multiple
+// times, in which case the values are concatenated. The first value given
+// replaces the default, and the first value given on the command line
+// replaces any from the environment.
+type listValue struct {
+	value   string
+	set     bool
+	fromEnv bool
+	// flags is the set the flag is registered in. envflag sets values from
+	// the environment before parsing it, so any value set while it is still
+	// unparsed came from the environment.
+	flags *flag.FlagSet
+}
+
+// listFlag defines a list flag with the given name, default value and usage
+func listFlag(name, value, usage string) *listValue {
+	l := &listValue{value: value, flags: flag.CommandLine}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return l.value
+}
+
+func (l *listValue) Set(s string) error {
+	fromEnv := l.flags != nil && !l.flags.Parsed()
+	if l.set && l.value != "" && l.fromEnv == fromEnv {
+		l.value += "," + s
+	} else {
+		l.value = s
+	}
+	l.set = true
+	l.fromEnv = fromEnv
+	return nil
+}
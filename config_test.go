@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csmith/envflag/v2"
+)
+
+func testConfigFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("wg-endpoint", "", "")
+	fs.String("wg-dns", "9.9.9.9", "")
+	fs.Int("wg-mtu", 1420, "")
+	fs.Duration("wg-health-check-period", 30*time.Second, "")
+	fs.String("tailscale-hostname", "tsv", "")
+	fs.String("log.level", "", "")
+	fs.String("profile", "", "")
+	return fs
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		args     []string
+		want     map[string]string
+		wantErrs []string
+	}{
+		{
+			name: "flat YAML",
+			file: "config.yml",
+			content: `
+wg-endpoint: vpn.example.com:51820
+wg-mtu: 1280
+`,
+			want: map[string]string{"wg-endpoint": "vpn.example.com:51820", "wg-mtu": "1280"},
+		},
+		{
+			name: "nested YAML with lists",
+			file: "config.yaml",
+			content: `
+wg:
+  endpoint: vpn.example.com:51820
+  dns:
+    - 1.1.1.1
+    - 1.0.0.1
+  health-check-period: 1m
+log:
+  level: debug
+`,
+			want: map[string]string{
+				"wg-endpoint":            "vpn.example.com:51820",
+				"wg-dns":                 "1.1.1.1,1.0.0.1",
+				"wg-health-check-period": "1m0s",
+				"log.level":              "debug",
+			},
+		},
+		{
+			name: "TOML",
+			file: "config.toml",
+			content: `
+tailscale-hostname = "gateway"
+
+[wg]
+endpoint = "vpn.example.com:51820"
+dns = ["1.1.1.1", "1.0.0.1"]
+mtu = 1280
+`,
+			want: map[string]string{
+				"tailscale-hostname": "gateway",
+				"wg-endpoint":        "vpn.example.com:51820",
+				"wg-dns":             "1.1.1.1,1.0.0.1",
+				"wg-mtu":             "1280",
+			},
+		},
+		{
+			name: "flags take precedence",
+			file: "config.yml",
+			content: `
+wg-endpoint: vpn.example.com:51820
+tailscale-hostname: gateway
+`,
+			args: []string{"--wg-endpoint=other.example.com:51820"},
+			want: map[string]string{"wg-endpoint": "other.example.com:51820", "tailscale-hostname": "gateway"},
+		},
+		{
+			name: "TOML errors are reported with lines",
+			file: "config.toml",
+			content: `
+wg-endpont = "vpn.example.com:51820"
+
+[wg]
+dns = ["1.1.1.1"]
+mtu = "big"
+
+[[servers]]
+endpoint = "a.example.com:51820"
+`,
+			wantErrs: []string{
+				`config.toml:2: unknown setting "wg-endpont"`,
+				`config.toml:6: invalid value for wg-mtu`,
+				`config.toml:8: lists may only contain simple values (servers)`,
+			},
+		},
+		{
+			name:     "TOML syntax errors are reported with lines",
+			file:     "config.toml",
+			content:  "wg-endpoint = \"vpn.example.com:51820\"\nwg-mtu = \n",
+			wantErrs: []string{`config.toml:2: failed to parse config file`},
+		},
+		{
+			name: "profile selected by flag",
+			file: "config.yml",
+			content: `
+wg:
+  endpoint: vpn.example.com:51820
+  mtu: 1280
+profiles:
+  streaming-us:
+    wg-endpoint: us.example.com:51820
+  privacy-eu:
+    wg:
+      endpoint: eu.example.com:51820
+      dns: [9.9.9.9]
+`,
+			args: []string{"--profile=privacy-eu"},
+			want: map[string]string{"wg-endpoint": "eu.example.com:51820", "wg-dns": "9.9.9.9", "wg-mtu": "1280"},
+		},
+		{
+			name: "profile selected by file",
+			file: "config.toml",
+			content: `
+profile = "streaming-us"
+wg-endpoint = "vpn.example.com:51820"
+
+[profiles.streaming-us]
+wg-endpoint = "us.example.com:51820"
+
+[profiles.privacy-eu]
+wg-endpoint = "eu.example.com:51820"
+`,
+			want: map[string]string{"wg-endpoint": "us.example.com:51820", "profile": "streaming-us"},
+		},
+		{
+			name: "flags take precedence over profiles",
+			file: "config.yml",
+			content: `
+profiles:
+  streaming-us:
+    wg-endpoint: us.example.com:51820
+    tailscale-hostname: us
+`,
+			args: []string{"--profile=streaming-us", "--wg-endpoint=other.example.com:51820"},
+			want: map[string]string{"wg-endpoint": "other.example.com:51820", "tailscale-hostname": "us"},
+		},
+		{
+			name: "unknown profile",
+			file: "config.yml",
+			content: `
+profiles:
+  streaming-us:
+    wg-endpoint: us.example.com:51820
+`,
+			args:     []string{"--profile=streaming-uk"},
+			wantErrs: []string{`profile "streaming-uk" not found`},
+		},
+		{
+			name: "unknown keys and bad values are reported with lines",
+			file: "config.yml",
+			content: `
+wg-endpont: vpn.example.com:51820
+wg:
+  mtu: big
+`,
+			wantErrs: []string{
+				`config.yml:2: unknown setting "wg-endpont"`,
+				`config.yml:4: invalid value for wg-mtu`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testConfigFlagSet()
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyConfigFile(fs, writeConfig(t, tt.file, tt.content))
+			if len(tt.wantErrs) > 0 {
+				if err == nil {
+					t.Fatalf("applyConfigFile() expected errors")
+				}
+				for _, want := range tt.wantErrs {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("applyConfigFile() error %q does not contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyConfigFile() error = %v", err)
+			}
+
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("flag %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	keyFile := writeConfig(t, "key", "secret-key\n")
+	path := writeConfig(t, "config.yaml", "wg-endpoint: vpn.example.com:51820\n")
+
+	fs := testConfigFlagSet()
+	fs.String("wg-private-key", "", "")
+	fs.String("wg-private-key-file", "", "")
+	fs.String("wg-preshared-key", "", "")
+	fs.String("state-passphrase", "", "")
+	if err := fs.Parse([]string{"-wg-mtu=1280", "-state-passphrase=hunter2", "-wg-private-key-file=" + keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	explicit := explicitFlags(fs)
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := readSecretFiles(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	if err := dumpConfig(&buf, fs, explicit); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]effectiveValue
+	if err := json.Unmarshal([]byte(buf.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]effectiveValue{
+		"wg-endpoint":      {Value: "vpn.example.com:51820", Source: "config file"},
+		"wg-dns":           {Value: "9.9.9.9", Source: "default"},
+		"wg-mtu":           {Value: "1280", Source: "flag or environment"},
+		"wg-private-key":   {Value: "REDACTED", Source: "secret file"},
+		"wg-preshared-key": {Value: "", Source: "default"},
+		"state-passphrase": {Value: "REDACTED", Source: "flag or environment"},
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %+v, want %+v", name, got[name], value)
+		}
+	}
+
+	if strings.Contains(buf.String(), "secret-key") || strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("output contains secrets: %s", buf.String())
+	}
+}
+
+func TestListValue(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "default", want: "0.0.0.0/0,::/0"},
+		{name: "single value replaces default", args: []string{"-list=10.0.0.0/8"}, want: "10.0.0.0/8"},
+		{name: "repeated values", args: []string{"-list=10.0.0.0/8", "-list", "192.168.0.0/16,fd00::/8"}, want: "10.0.0.0/8,192.168.0.0/16,fd00::/8"},
+		{name: "empty value clears default", args: []string{"-list="}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &listValue{value: "0.0.0.0/0,::/0"}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Var(l, "list", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := l.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListValueEnvironment(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want string
+	}{
+		{name: "environment replaces default", env: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{name: "flag replaces environment", env: "10.0.0.0/8", args: []string{"-list=192.168.0.0/16"}, want: "192.168.0.0/16"},
+		{name: "repeated flags replace environment", env: "10.0.0.0/8", args: []string{"-list=192.168.0.0/16", "-list=fd00::/8"}, want: "192.168.0.0/16,fd00::/8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LIST", tt.env)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			l := &listValue{value: "0.0.0.0/0,::/0", flags: fs}
+			fs.Var(l, "list", "")
+			envflag.Parse(envflag.WithFlagSet(fs), envflag.WithArguments(tt.args))
+			if got := l.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	maxConnections          = flag.Int("max-connections", 0, "Maximum number of connections proxied at once (0 for unlimited)")
+	maxConnectionsPerSource = flag.Int("max-connections-per-source", 0, "Maximum number of connections proxied at once for each tailnet address (0 for unlimited)")
+	connectionLimitPolicy   = flag.String("connection-limit-policy", "reject", "What to do with connections over the limit: 'reject' them, or 'queue' them until a slot is free")
+	connectionQueueTimeout  = flag.Duration("connection-queue-timeout", 10*time.Second, "How long a queued connection waits for a free slot before being rejected")
+)
+
+// connectionLimiter limits how many connections are proxied at once, both in
+// total and from each source
+type connectionLimiter struct {
+	max          int
+	maxPerSource int
+	queue        bool
+	queueTimeout time.Duration
+
+	mutex    sync.Mutex
+	total    int
+	bySource map[netip.Addr]int
+
+	// released is closed (and replaced) whenever a connection finishes, to
+	// wake up any queued connections
+	released chan struct{}
+}
+
+// newConnectionLimiter creates a limiter from the command line flags, or
+// returns nil if connections aren't limited
+func newConnectionLimiter() *connectionLimiter {
+	if *maxConnections <= 0 && *maxConnectionsPerSource <= 0 {
+		return nil
+	}
+
+	return &connectionLimiter{
+		max:          *maxConnections,
+		maxPerSource: *maxConnectionsPerSource,
+		queue:        *connectionLimitPolicy == "queue",
+		queueTimeout: *connectionQueueTimeout,
+		bySource:     make(map[netip.Addr]int),
+		released:     make(chan struct{}),
+	}
+}
+
+// acquire reserves a slot for a connection from src, waiting for one to be
+// freed if the policy is to queue. It returns false if the connection should
+// be rejected.
+func (l *connectionLimiter) acquire(ctx context.Context, src netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	var timeout <-chan time.Time
+	for {
+		l.mutex.Lock()
+		if l.reserve(src) {
+			l.mutex.Unlock()
+			return true
+		}
+		released := l.released
+		l.mutex.Unlock()
+
+		if !l.queue {
+			return false
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(l.queueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-released:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// tryAcquire reserves a slot for a connection from src if one is free,
+// without waiting regardless of the policy
+func (l *connectionLimiter) tryAcquire(src netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.reserve(src)
+}
+
+// reserve takes a slot for src if neither limit has been reached. The mutex
+// must be held.
+func (l *connectionLimiter) reserve(src netip.Addr) bool {
+	if (l.max > 0 && l.total >= l.max) || (l.maxPerSource > 0 && l.bySource[src] >= l.maxPerSource) {
+		return false
+	}
+	l.total++
+	l.bySource[src]++
+	return true
+}
+
+// queues returns whether connections over the limit should wait for a slot
+func (l *connectionLimiter) queues() bool {
+	return l != nil && l.queue
+}
+
+// release frees the slot held by a connection from src
+func (l *connectionLimiter) release(src netip.Addr) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.total--
+	if l.bySource[src] <= 1 {
+		delete(l.bySource, src)
+	} else {
+		l.bySource[src]--
+	}
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
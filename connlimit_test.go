@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	a := netip.MustParseAddr("100.64.0.1")
+	b := netip.MustParseAddr("100.64.0.2")
+	c := netip.MustParseAddr("100.64.0.3")
+	ctx := context.Background()
+
+	t.Run("unlimited", func(t *testing.T) {
+		var l *connectionLimiter
+		if !l.acquire(ctx, a) {
+			t.Error("acquire() on nil limiter = false, want true")
+		}
+		l.release(a)
+	})
+
+	t.Run("rejects over the limits", func(t *testing.T) {
+		l := &connectionLimiter{max: 3, maxPerSource: 2, bySource: make(map[netip.Addr]int), released: make(chan struct{})}
+
+		steps := []struct {
+			src  netip.Addr
+			want bool
+		}{
+			{a, true},
+			{a, true},
+			{a, false}, // per source limit
+			{b, true},
+			{c, false}, // global limit
+		}
+		for i, step := range steps {
+			if got := l.acquire(ctx, step.src); got != step.want {
+				t.Errorf("step %d: acquire(%s) = %v, want %v", i, step.src, got, step.want)
+			}
+		}
+
+		l.release(a)
+		if !l.acquire(ctx, c) {
+			t.Error("acquire() after release = false, want true")
+		}
+	})
+
+	t.Run("queues until a slot is free", func(t *testing.T) {
+		l := &connectionLimiter{max: 1, queue: true, queueTimeout: time.Second, bySource: make(map[netip.Addr]int), released: make(chan struct{})}
+		if !l.acquire(ctx, a) {
+			t.Fatal("acquire() = false, want true")
+		}
+
+		time.AfterFunc(50*time.Millisecond, func() { l.release(a) })
+		start := time.Now()
+		if !l.acquire(ctx, b) {
+			t.Fatal("queued acquire() = false, want true")
+		}
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("queued acquire() returned after %s, before a slot was freed", elapsed)
+		}
+	})
+
+	t.Run("gives up after the queue timeout", func(t *testing.T) {
+		l := &connectionLimiter{max: 1, queue: true, queueTimeout: 50 * time.Millisecond, bySource: make(map[netip.Addr]int), released: make(chan struct{})}
+		if !l.acquire(ctx, a) {
+			t.Fatal("acquire() = false, want true")
+		}
+		if l.acquire(ctx, b) {
+			t.Error("acquire() with no free slot = true, want false")
+		}
+	})
+}
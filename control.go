@@ -0,0 +1,431 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/net/netcheck"
+)
+
+var (
+	controlSocket = flag.String("control-socket", "", "Path of a Unix socket to serve the control interface on, used by `tsv status` and `tsv control` (disabled if blank)")
+)
+
+// Status describes the current state of a running node
+type Status struct {
+	Tailscale         TailscaleStatus  `json:"tailscale"`
+	Upstream          string           `json:"upstream"`
+	WireGuard         *WireGuardStatus `json:"wireguard,omitempty"`
+	ActiveConnections int64            `json:"active_connections"`
+	Paused            bool             `json:"paused"`
+	Netcheck          *NetcheckStatus  `json:"netcheck,omitempty"`
+	RouteChanges      []RouteChange    `json:"route_changes,omitempty"`
+}
+
+// TailscaleStatus describes the state of the Tailscale node
+type TailscaleStatus struct {
+	State            string         `json:"state"`
+	Hostname         string         `json:"hostname"`
+	Addresses        []netip.Addr   `json:"addresses"`
+	AdvertisedRoutes []netip.Prefix `json:"advertised_routes"`
+	ApprovedRoutes   []netip.Prefix `json:"approved_routes"`
+	KeyExpiry        *time.Time     `json:"key_expiry,omitempty"`
+	DERPRegion       string         `json:"derp_region,omitempty"`
+	Peers            int            `json:"peers"`
+}
+
+// ControlServer serves the control interface for a running node
+type ControlServer struct {
+	proxy    *Proxy
+	wg       *WireGuardClient
+	lc       *local.Client
+	routes   *RouteAdvertiser
+	explicit map[string]bool
+
+	// netcheck returns the node's most recent netcheck report, if any
+	netcheck func(context.Context) *netcheck.Report
+}
+
+// controlOperations are the admin operations offered by the control interface
+var controlOperations = []string{"reload", "pause", "resume", "resolve", "restart"}
+
+// Status collects the current state of the node, including the results of
+// its latest netcheck and recent route changes if verbose is set
+func (c *ControlServer) Status(ctx context.Context, verbose bool) (*Status, error) {
+	status := &Status{
+		Upstream:          *upstream,
+		ActiveConnections: c.proxy.ActiveConnections(),
+		Paused:            c.proxy.Paused(),
+	}
+
+	if c.lc != nil {
+		st, err := c.lc.Status(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Tailscale status: %w", err)
+		}
+		status.Tailscale.State = st.BackendState
+		status.Tailscale.Addresses = st.TailscaleIPs
+		status.Tailscale.Peers = len(st.Peer)
+
+		prefs, err := c.lc.GetPrefs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Tailscale prefs: %w", err)
+		}
+		status.Tailscale.AdvertisedRoutes = prefs.AdvertiseRoutes
+
+		if st.Self != nil {
+			status.Tailscale.Hostname = st.Self.HostName
+			status.Tailscale.KeyExpiry = st.Self.KeyExpiry
+			status.Tailscale.DERPRegion = st.Self.Relay
+			if st.Self.AllowedIPs != nil {
+				status.Tailscale.ApprovedRoutes = approvedRoutes(prefs.AdvertiseRoutes, st.Self.AllowedIPs.AsSlice())
+			}
+		}
+
+		if verbose && c.netcheck != nil {
+			if report := c.netcheck(ctx); report != nil {
+				dm, err := c.lc.CurrentDERPMap(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get DERP map: %w", err)
+				}
+				status.Netcheck = netcheckStatus(dm, report)
+			}
+		}
+	}
+
+	if verbose && c.routes != nil {
+		status.RouteChanges = c.routes.History()
+	}
+
+	if c.wg != nil {
+		wgStatus, err := c.wg.Status()
+		if err != nil {
+			return nil, err
+		}
+		status.WireGuard = &wgStatus
+	}
+
+	return status, nil
+}
+
+// approvedRoutes returns the advertised routes that control has allowed the
+// node to route
+func approvedRoutes(advertised, allowed []netip.Prefix) []netip.Prefix {
+	var res []netip.Prefix
+	for _, route := range advertised {
+		if slices.Contains(allowed, route) {
+			res = append(res, route)
+		}
+	}
+	return res
+}
+
+// Serve listens on the Unix socket at path until ctx is cancelled
+func (c *ControlServer) Serve(ctx context.Context, path string) error {
+	// Remove any socket left over from a previous run
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+
+	server := &http.Server{Handler: c.handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	slog.Info("Serving control interface", "socket", path)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// handler returns the HTTP handler for the control interface
+func (c *ControlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := c.Status(r.Context(), r.URL.Query().Has("verbose"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("POST /{operation}", func(w http.ResponseWriter, r *http.Request) {
+		operation := r.PathValue("operation")
+		slog.Info("Control operation requested", "operation", operation)
+		if err := c.perform(operation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.routes.Settings())
+	})
+	mux.HandleFunc("GET /routes/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.routes.History())
+	})
+	mux.HandleFunc("PUT /routes/{addr}/{bits}", c.handleRoute(c.routes.AddRoute))
+	mux.HandleFunc("DELETE /routes/{addr}/{bits}", c.handleRoute(c.routes.RemoveRoute))
+	mux.HandleFunc("PUT /exit-node", c.handleExitNode(true))
+	mux.HandleFunc("DELETE /exit-node", c.handleExitNode(false))
+	return mux
+}
+
+// handleRoute returns a handler that passes the route in the request path to
+// change
+func (c *ControlServer) handleRoute(change func(context.Context, netip.Prefix) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, err := netip.ParsePrefix(r.PathValue("addr") + "/" + r.PathValue("bits"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		slog.Info("Route change requested", "method", r.Method, "route", route)
+		if err := change(r.Context(), route); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleExitNode returns a handler that enables or disables the exit node
+func (c *ControlServer) handleExitNode(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Exit node change requested", "enabled", enabled)
+		if err := c.routes.SetExitNode(r.Context(), enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// perform carries out one of the controlOperations
+func (c *ControlServer) perform(operation string) error {
+	switch operation {
+	case "reload":
+		return ReloadConfig(c.wg, c.explicit)
+	case "pause":
+		c.proxy.SetPaused(true)
+		return nil
+	case "resume":
+		c.proxy.SetPaused(false)
+		return nil
+	case "resolve", "restart":
+		if c.wg == nil {
+			return fmt.Errorf("%s is only supported with the wireguard upstream", operation)
+		}
+		if operation == "restart" {
+			c.wg.Restart()
+			return nil
+		}
+		return c.wg.ResolveEndpoint()
+	default:
+		return fmt.Errorf("unknown operation %q", operation)
+	}
+}
+
+// controlClient returns an HTTP client that connects to the control socket at path
+func controlClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+// controlRequest makes a request to the control interface of a running node,
+// decoding the response into res (if non-nil)
+func controlRequest(ctx context.Context, path, method, endpoint string, res any) error {
+	if path == "" {
+		return fmt.Errorf("--control-socket is required")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://tsv"+endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := controlClient(path).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to tsv (is it running?): %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if res != nil {
+		return json.NewDecoder(resp.Body).Decode(res)
+	}
+	return nil
+}
+
+// RunControl asks the node running with the control socket at path to
+// perform an admin operation
+func RunControl(ctx context.Context, path string, args []string) error {
+	if len(args) != 1 || !slices.Contains(controlOperations, args[0]) {
+		return fmt.Errorf("usage: tsv control <%s>", strings.Join(controlOperations, "|"))
+	}
+
+	if err := controlRequest(ctx, path, http.MethodPost, "/"+args[0], nil); err != nil {
+		return err
+	}
+	slog.Info("Control operation completed", "operation", args[0])
+	return nil
+}
+
+// RunStatus prints the status of the node running with the control socket at
+// path, in JSON if requested in args
+func RunStatus(ctx context.Context, w io.Writer, path string, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "Output the status as JSON")
+	verbose := fs.Bool("verbose", false, "Include the node's latest netcheck results")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	endpoint := "/status"
+	if *verbose {
+		endpoint += "?verbose"
+	}
+
+	var status Status
+	if err := controlRequest(ctx, path, http.MethodGet, endpoint, &status); err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+
+	printStatus(w, &status, time.Now())
+	return nil
+}
+
+// printStatus writes a human-readable summary of status
+func printStatus(w io.Writer, status *Status, now time.Time) {
+	addrs := make([]string, len(status.Tailscale.Addresses))
+	for i, addr := range status.Tailscale.Addresses {
+		addrs[i] = addr.String()
+	}
+	routes := make([]string, len(status.Tailscale.AdvertisedRoutes))
+	for i, route := range status.Tailscale.AdvertisedRoutes {
+		routes[i] = route.String()
+		if !slices.Contains(status.Tailscale.ApprovedRoutes, route) {
+			routes[i] += " (unapproved)"
+		}
+	}
+
+	fmt.Fprintf(w, "Tailscale:    %s as %s (%s)\n", status.Tailscale.State, status.Tailscale.Hostname, strings.Join(addrs, ", "))
+	fmt.Fprintf(w, "Network:      %d peers, DERP region %s\n", status.Tailscale.Peers, cmp.Or(status.Tailscale.DERPRegion, "unknown"))
+	if status.Tailscale.KeyExpiry != nil {
+		fmt.Fprintf(w, "Key expiry:   %s\n", status.Tailscale.KeyExpiry.UTC().Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "Key expiry:   never\n")
+	}
+	fmt.Fprintf(w, "Routes:       %s\n", strings.Join(routes, ", "))
+	fmt.Fprintf(w, "Upstream:     %s\n", status.Upstream)
+
+	if wg := status.WireGuard; wg != nil {
+		handshake := "never"
+		if !wg.LastHandshake.IsZero() {
+			handshake = formatAge(now, wg.LastHandshake)
+		}
+		fmt.Fprintf(w, "WireGuard:    %s, last handshake %s\n", wg.Endpoint, handshake)
+
+		switch {
+		case wg.LastHealthCheck.IsZero():
+			fmt.Fprintf(w, "Health check: pending\n")
+		case wg.Healthy:
+			fmt.Fprintf(w, "Health check: passing (checked %s)\n", formatAge(now, wg.LastHealthCheck))
+		default:
+			fmt.Fprintf(w, "Health check: failing, %d consecutive failures (checked %s)\n", wg.ConsecutiveFailures, formatAge(now, wg.LastHealthCheck))
+		}
+	}
+
+	if status.Paused {
+		fmt.Fprintf(w, "Connections:  %d active, new connections paused\n", status.ActiveConnections)
+	} else {
+		fmt.Fprintf(w, "Connections:  %d active\n", status.ActiveConnections)
+	}
+
+	if nc := status.Netcheck; nc != nil {
+		udp := "working"
+		if !nc.UDP {
+			udp = "blocked"
+		}
+		fmt.Fprintf(w, "UDP:          %s\n", udp)
+		fmt.Fprintf(w, "Public IPs:   %s, %s\n", formatAddrPort(nc.IPv4), formatAddrPort(nc.IPv6))
+		fmt.Fprintf(w, "NAT:          hard NAT %v, UPnP %v, NAT-PMP %v, PCP %v\n", nc.HardNAT, nc.UPnP, nc.PMP, nc.PCP)
+		fmt.Fprintf(w, "Nearest DERP: %s\n", cmp.Or(nc.PreferredDERP, "unknown"))
+		for _, derp := range nc.DERPLatency {
+			fmt.Fprintf(w, "  %-5s %-8s (%s)\n", derp.Code, derp.Latency.Round(time.Millisecond/10), derp.Name)
+		}
+	}
+
+	if len(status.RouteChanges) > 0 {
+		fmt.Fprintf(w, "Route changes:\n")
+		for _, change := range status.RouteChanges {
+			var parts []string
+			for _, route := range change.Added {
+				parts = append(parts, "+"+route.String())
+			}
+			for _, route := range change.Removed {
+				parts = append(parts, "-"+route.String())
+			}
+			fmt.Fprintf(w, "  %s %s (%s)\n", change.Time.UTC().Format(time.RFC3339), strings.Join(parts, " "), change.Trigger)
+		}
+	}
+}
+
+// formatAddrPort formats a public address found by netcheck
+func formatAddrPort(addr netip.AddrPort) string {
+	if !addr.IsValid() {
+		return "none"
+	}
+	return addr.String()
+}
+
+// formatAge describes how long ago t was
+func formatAge(now, t time.Time) string {
+	return fmt.Sprintf("%s ago", now.Sub(t).Truncate(time.Second))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+func startTestControlServer(t *testing.T, c *ControlServer) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := c.Serve(ctx, path); err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for range 100 {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("control socket was not created")
+	return ""
+}
+
+func TestRunStatus(t *testing.T) {
+	proxy := &Proxy{}
+	proxy.count.Store(3)
+	path := startTestControlServer(t, &ControlServer{proxy: proxy})
+
+	var out strings.Builder
+	if err := RunStatus(context.Background(), &out, path, []string{"--json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var status Status
+	if err := json.Unmarshal([]byte(out.String()), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ActiveConnections != 3 || status.Upstream != *upstream {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	out.Reset()
+	if err := RunStatus(context.Background(), &out, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Connections:  3 active") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestRunStatus_NotRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.sock")
+	if err := RunStatus(context.Background(), &strings.Builder{}, path, nil); err == nil {
+		t.Error("expected an error when nothing is listening")
+	}
+	if err := RunStatus(context.Background(), &strings.Builder{}, "", nil); err == nil {
+		t.Error("expected an error without a control socket")
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	expiry := time.Date(2025, 6, 30, 12, 0, 0, 0, time.UTC)
+	status := &Status{
+		Tailscale: TailscaleStatus{
+			State:            "Running",
+			Hostname:         "tsv",
+			Addresses:        []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+			AdvertisedRoutes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			ApprovedRoutes:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+			KeyExpiry:        &expiry,
+			DERPRegion:       "lhr",
+			Peers:            3,
+		},
+		Upstream: "wireguard",
+		WireGuard: &WireGuardStatus{
+			Endpoint:            "192.0.2.1:51820",
+			LastHandshake:       now.Add(-42 * time.Second),
+			LastHealthCheck:     now.Add(-10 * time.Second),
+			ConsecutiveFailures: 2,
+		},
+		ActiveConnections: 5,
+	}
+
+	var out strings.Builder
+	printStatus(&out, status, now)
+
+	want := `Tailscale:    Running as tsv (100.64.0.1, fd7a:115c:a1e0::1)
+Network:      3 peers, DERP region lhr
+Key expiry:   2025-06-30T12:00:00Z
+Routes:       0.0.0.0/0, ::/0 (unapproved)
+Upstream:     wireguard
+WireGuard:    192.0.2.1:51820, last handshake 42s ago
+Health check: failing, 2 consecutive failures (checked 10s ago)
+Connections:  5 active
+`
+	if out.String() != want {
+		t.Errorf("printStatus() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestPrintStatusNetcheck(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "lhr", RegionName: "London"},
+		2: {RegionID: 2, RegionCode: "fra", RegionName: "Frankfurt"},
+	}}
+	report := &netcheck.Report{
+		UDP:                   true,
+		GlobalV4:              netip.MustParseAddrPort("192.0.2.10:41641"),
+		MappingVariesByDestIP: opt.NewBool(false),
+		UPnP:                  opt.NewBool(true),
+		PreferredDERP:         1,
+		RegionLatency:         map[int]time.Duration{1: 12 * time.Millisecond, 2: 25 * time.Millisecond, 3: time.Millisecond},
+	}
+
+	// Round trip through JSON, as the status command does
+	data, err := json.Marshal(&Status{Upstream: "mock", Netcheck: netcheckStatus(dm, report)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	printStatus(&out, &status, time.Now())
+
+	want := `UDP:          working
+Public IPs:   192.0.2.10:41641, none
+NAT:          hard NAT false, UPnP true, NAT-PMP false, PCP false
+Nearest DERP: London
+  lhr   12ms     (London)
+  fra   25ms     (Frankfurt)
+`
+	if !strings.HasSuffix(out.String(), want) {
+		t.Errorf("printStatus() =\n%s\nwant suffix\n%s", out.String(), want)
+	}
+}
+
+func TestPrintStatusRouteChanges(t *testing.T) {
+	status := &Status{Upstream: "mock", RouteChanges: []RouteChange{{
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Added:   []netip.Prefix{netip.MustParsePrefix("8.8.8.0/24")},
+		Removed: []netip.Prefix{netip.MustParsePrefix("8.8.4.0/24")},
+		Trigger: "added 8.8.8.0/24",
+	}}}
+
+	var out strings.Builder
+	printStatus(&out, status, time.Now())
+
+	want := "Route changes:\n  2026-01-02T03:04:05Z +8.8.8.0/24 -8.8.4.0/24 (added 8.8.8.0/24)\n"
+	if !strings.HasSuffix(out.String(), want) {
+		t.Errorf("printStatus() =\n%s\nwant suffix\n%s", out.String(), want)
+	}
+}
+
+func TestRunControl(t *testing.T) {
+	proxy := &Proxy{}
+	path := startTestControlServer(t, &ControlServer{proxy: proxy})
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantErr    bool
+		wantPaused bool
+	}{
+		{name: "pause", args: []string{"pause"}, wantPaused: true},
+		{name: "resume", args: []string{"resume"}},
+		{name: "restart without wireguard", args: []string{"restart"}, wantErr: true},
+		{name: "unknown operation", args: []string{"explode"}, wantErr: true},
+		{name: "no operation", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RunControl(context.Background(), path, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunControl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if proxy.Paused() != tt.wantPaused {
+				t.Errorf("Paused() = %v, want %v", proxy.Paused(), tt.wantPaused)
+			}
+		})
+	}
+}
+
+func TestApprovedRoutes(t *testing.T) {
+	advertised := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"), netip.MustParsePrefix("203.0.113.0/24")}
+	allowed := []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("::/0"), netip.MustParsePrefix("203.0.113.0/24")}
+
+	got := approvedRoutes(advertised, allowed)
+	want := []netip.Prefix{netip.MustParsePrefix("::/0"), netip.MustParsePrefix("203.0.113.0/24")}
+	if !slices.Equal(got, want) {
+		t.Errorf("approvedRoutes() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+var (
+	excludeIPs = listFlag("exclude-ips", "", "Destinations that must never be proxied or advertised (comma-separated IPs or CIDR prefixes, may be repeated; e.g. 10.0.0.0/8)")
+)
+
+// bogonRoutes are private and reserved ranges (including those reserved for
+// documentation and benchmarking) that aren't advertised unless
+// --tailscale-allow-bogon-routes is set
+var bogonRoutes = prefixSet{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// tailscaleRoutes are the ranges Tailscale assigns node addresses from
+var tailscaleRoutes = prefixSet{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+}
+
+// prefixSet is a list of prefixes that addresses and routes can be matched against
+type prefixSet []netip.Prefix
+
+// parsePrefixSet parses a comma-separated list of prefixes. Bare IP addresses
+// are treated as single-address prefixes.
+func parsePrefixSet(s string) (prefixSet, error) {
+	var res prefixSet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, err := parsePrefixOrAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %s: %w", entry, err)
+		}
+		res = append(res, prefix)
+	}
+	return res, nil
+}
+
+// contains returns whether addr is in any of the prefixes
+func (p prefixSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps returns whether any part of route is within one of the prefixes
+func (p prefixSet) overlaps(route netip.Prefix) bool {
+	for _, prefix := range p {
+		if prefix.Overlaps(route) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns whether the whole of route is within one of the prefixes
+func (p prefixSet) covers(route netip.Prefix) bool {
+	for _, prefix := range p {
+		if prefix.Bits() <= route.Bits() && prefix.Contains(route.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixSet(t *testing.T) {
+	set, err := parsePrefixSet("10.0.0.0/8, 192.168.1.1, fd00::/8,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrTests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"fd12::1", true},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range addrTests {
+		if got := set.contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	routeTests := []struct {
+		route string
+		want  bool
+	}{
+		{"10.0.0.0/8", true},
+		{"10.20.0.0/16", true},
+		{"0.0.0.0/0", false},
+		{"192.168.1.0/24", false},
+		{"192.168.1.1/32", true},
+	}
+	for _, tt := range routeTests {
+		if got := set.covers(netip.MustParsePrefix(tt.route)); got != tt.want {
+			t.Errorf("covers(%s) = %v, want %v", tt.route, got, tt.want)
+		}
+	}
+
+	if _, err := parsePrefixSet("10.0.0.0/8,bogus"); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+}
+
+func TestBogonRoutes(t *testing.T) {
+	tests := []struct {
+		route string
+		want  bool
+	}{
+		{"0.0.0.0/0", false},
+		{"::/0", false},
+		{"8.8.8.0/24", false},
+		{"10.1.0.0/16", true},
+		{"100.100.100.100/32", true},
+		{"127.0.0.1/32", true},
+		{"192.168.0.0/16", true},
+		{"192.0.0.0/2", false},
+		{"203.0.113.0/24", true},
+		{"198.19.0.0/16", true},
+		{"2001:db8::/32", true},
+		{"2606:4700::/32", false},
+		{"fd00::/8", true},
+		{"fe80::1/128", true},
+	}
+	for _, tt := range tests {
+		if got := bogonRoutes.covers(netip.MustParsePrefix(tt.route)); got != tt.want {
+			t.Errorf("bogonRoutes.covers(%s) = %v, want %v", tt.route, got, tt.want)
+		}
+	}
+}
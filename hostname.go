@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	tsHostnameSuffix = flag.String("tailscale-hostname-suffix", "", "Append details of the exit to the Tailscale hostname: 'provider' for --wg-provider and --wg-provider-country (e.g. tsv-mullvad-nl), or 'country' for the country detected via the upstream (e.g. tsv-nl)")
+	egressCountryURL = flag.String("egress-country-url", "https://ipinfo.io/country", "URL fetched via the upstream to detect the exit country for --tailscale-hostname-suffix=country, which must respond with a country code")
+)
+
+// nodeHostname returns the Tailscale hostname to use, with any configured
+// suffix added. If the suffix can't be determined the plain hostname is used.
+func nodeHostname(ctx context.Context, dialer Dialer) string {
+	var parts []string
+	switch *tsHostnameSuffix {
+	case "provider":
+		parts = []string{*wgProvider, *wgProviderCountry}
+	case "country":
+		country, err := detectEgressCountry(ctx, dialer, *egressCountryURL)
+		if err != nil {
+			slog.Warn("Failed to detect exit country for hostname", "error", err)
+			return *tsHostname
+		}
+		parts = []string{country}
+	default:
+		return *tsHostname
+	}
+
+	return appendHostnameSuffix(*tsHostname, parts...)
+}
+
+// appendHostnameSuffix appends each non-empty part to hostname, separated by
+// hyphens, after removing characters that aren't valid in a hostname
+func appendHostnameSuffix(hostname string, parts ...string) string {
+	for _, part := range parts {
+		part = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+				return r
+			case r >= 'A' && r <= 'Z':
+				return r - 'A' + 'a'
+			default:
+				return -1
+			}
+		}, part)
+		if part != "" {
+			hostname += "-" + part
+		}
+	}
+	return hostname
+}
+
+// detectEgressCountry fetches url via the dialer, returning the country code
+// it responds with
+func detectEgressCountry(ctx context.Context, dialer Dialer, url string) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+
+	country := strings.TrimSpace(string(body))
+	if len(country) != 2 {
+		return "", fmt.Errorf("unexpected country code %q", country)
+	}
+	return strings.ToLower(country), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAppendHostnameSuffix(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []string
+		want  string
+	}{
+		{name: "provider and country", parts: []string{"mullvad", "NL"}, want: "tsv-mullvad-nl"},
+		{name: "empty parts", parts: []string{"mullvad", ""}, want: "tsv-mullvad"},
+		{name: "invalid characters", parts: []string{"my provider!"}, want: "tsv-myprovider"},
+		{name: "no parts", want: "tsv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendHostnameSuffix("tsv", tt.parts...); got != tt.want {
+				t.Errorf("appendHostnameSuffix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// serverDialer dials a fixed address, regardless of the address requested
+type serverDialer string
+
+func (d serverDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, string(d))
+}
+
+func TestDetectEgressCountry(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "country code", body: "NL\n", want: "nl"},
+		{name: "unexpected response", body: "<html>", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			dialer := serverDialer(server.Listener.Addr().String())
+			got, err := detectEgressCountry(context.Background(), dialer, "http://country.example/")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectEgressCountry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectEgressCountry() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// generatedConfig is a config file written by the init and migrate commands
+type generatedConfig struct {
+	WG struct {
+		PrivateKey      string `yaml:"private-key"`
+		PublicKey       string `yaml:"public-key,omitempty"`
+		PresharedKey    string `yaml:"preshared-key,omitempty"`
+		Endpoint        string `yaml:"endpoint,omitempty"`
+		AllowedIPs      string `yaml:"allowed-ips,omitempty"`
+		Address         string `yaml:"address,omitempty"`
+		DNS             string `yaml:"dns,omitempty"`
+		MTU             int    `yaml:"mtu,omitempty"`
+		Provider        string `yaml:"provider,omitempty"`
+		ProviderAccount string `yaml:"provider-account,omitempty"`
+		ProviderCountry string `yaml:"provider-country,omitempty"`
+	} `yaml:"wg"`
+	Tailscale struct {
+		Hostname    string `yaml:"hostname,omitempty"`
+		ConfigDir   string `yaml:"config-dir,omitempty"`
+		ExtraRoutes string `yaml:"extra-routes,omitempty"`
+		ExitNode    *bool  `yaml:"exit-node,omitempty"`
+	} `yaml:"tailscale,omitempty"`
+}
+
+// prompter asks questions on an interactive terminal
+type prompter struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// ask prompts for a value until one is given that passes validate, using def
+// if the answer is blank
+func (p *prompter) ask(question, def string, validate func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+
+		if !p.in.Scan() {
+			if err := p.in.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+
+		answer := strings.TrimSpace(p.in.Text())
+		if answer == "" {
+			answer = def
+		}
+
+		err := validate(answer)
+		if err == nil {
+			return answer, nil
+		}
+		fmt.Fprintf(p.out, "  %v\n", err)
+	}
+}
+
+// RunInit interactively creates a config file at path, and a sample systemd
+// unit alongside it that runs binary with that config
+func RunInit(in io.Reader, out io.Writer, path, binary string) error {
+	unitPath := filepath.Join(filepath.Dir(path), "tsv.service")
+	for _, p := range []string{path, unitPath} {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s already exists", p)
+		}
+	}
+
+	p := &prompter{in: bufio.NewScanner(in), out: out}
+	var cfg generatedConfig
+
+	privateKey, err := p.ask("WireGuard private key (leave blank to generate one)", "", optional(validateWireGuardKey))
+	if err != nil {
+		return err
+	}
+	var publicKey string
+	if privateKey == "" {
+		privateKey, publicKey, err = GenerateWireGuardKey()
+	} else {
+		publicKey, err = wireGuardPublicKey(privateKey)
+	}
+	if err != nil {
+		return err
+	}
+	cfg.WG.PrivateKey = privateKey
+	fmt.Fprintf(out, "  Your WireGuard public key is %s\n", publicKey)
+
+	provider, err := p.ask("VPN provider to fetch the configuration from (mullvad, or blank to enter it manually)", "", func(s string) error {
+		if s != "" && s != "mullvad" {
+			return fmt.Errorf("only mullvad is supported")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if provider != "" {
+		cfg.WG.Provider = provider
+		if cfg.WG.ProviderAccount, err = p.ask("Account number", "", required); err != nil {
+			return err
+		}
+		if cfg.WG.ProviderCountry, err = p.ask("Country code to use servers from (blank for any)", "", optional(required)); err != nil {
+			return err
+		}
+	} else {
+		if cfg.WG.PublicKey, err = p.ask("Server's WireGuard public key", "", validateWireGuardKey); err != nil {
+			return err
+		}
+		if cfg.WG.PresharedKey, err = p.ask("Preshared key (blank for none)", "", optional(validateWireGuardKey)); err != nil {
+			return err
+		}
+		if cfg.WG.Endpoint, err = p.ask("Server endpoint (host:port)", "", required); err != nil {
+			return err
+		}
+		if cfg.WG.Address, err = p.ask("Interface addresses assigned by the server (comma-separated)", "", validateAddresses); err != nil {
+			return err
+		}
+		if cfg.WG.DNS, err = p.ask("DNS servers to use through the tunnel (comma-separated)", *wgDNS, validateAddresses); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Tailscale.Hostname, err = p.ask("Tailscale hostname", *tsHostname, required); err != nil {
+		return err
+	}
+	if cfg.Tailscale.ConfigDir, err = p.ask("Directory to store Tailscale state in", "/var/lib/tsv", required); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(&cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	fmt.Fprintf(out, "Wrote config to %s\n", path)
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(unitPath, []byte(systemdUnit(binary, "--config="+absPath)), 0644); err != nil {
+		return fmt.Errorf("failed to write systemd unit: %w", err)
+	}
+	fmt.Fprintf(out, "Wrote sample systemd unit to %s\n", unitPath)
+	return nil
+}
+
+// systemdUnit returns a systemd service definition that runs tsv with args
+func systemdUnit(binary string, args ...string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Tailscale VPN gateway
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+StateDirectory=tsv
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(append([]string{binary}, args...), " "))
+}
+
+// required checks that a value isn't blank
+func required(s string) error {
+	if s == "" {
+		return errors.New("a value is required")
+	}
+	return nil
+}
+
+// optional allows blank values, validating others with validate
+func optional(validate func(string) error) func(string) error {
+	return func(s string) error {
+		if s == "" {
+			return nil
+		}
+		return validate(s)
+	}
+}
+
+// validateWireGuardKey checks a value is a base64 encoded 32 byte key
+func validateWireGuardKey(s string) error {
+	if key, err := base64.StdEncoding.DecodeString(s); err != nil || len(key) != 32 {
+		return errors.New("keys must be 32 bytes, base64 encoded")
+	}
+	return nil
+}
+
+// validateAddresses checks a value is a comma-separated list of IP addresses
+// or prefixes
+func validateAddresses(s string) error {
+	if err := required(s); err != nil {
+		return err
+	}
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if _, err := netip.ParsePrefix(addr); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(addr); err != nil {
+			return fmt.Errorf("invalid address %s", addr)
+		}
+	}
+	return nil
+}
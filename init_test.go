@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "manual configuration",
+			input: []string{
+				"YJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=",
+				"",
+				"not a key",
+				"ZJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=",
+				"",
+				"vpn.example.com:51820",
+				"10.0.0.2/32, fd00::2/128",
+				"",
+				"gateway",
+				"",
+			},
+			want: []string{
+				"private-key: YJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=",
+				"public-key: ZJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=",
+				"endpoint: vpn.example.com:51820",
+				"address: 10.0.0.2/32, fd00::2/128",
+				"dns: 9.9.9.9",
+				"hostname: gateway",
+				"config-dir: /var/lib/tsv",
+			},
+		},
+		{
+			name:  "provider with generated key",
+			input: []string{"", "mullvad", "1234", "se", "", ""},
+			want: []string{
+				"private-key: ",
+				"provider: mullvad",
+				"provider-account: \"1234\"",
+				"provider-country: se",
+				"hostname: tsv",
+			},
+		},
+		{
+			name:    "input ends early",
+			input:   []string{"", ""},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tsv.yaml")
+			in := strings.NewReader(strings.Join(tt.input, "\n") + "\n")
+
+			err := RunInit(in, &strings.Builder{}, path, "/usr/bin/tsv")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunInit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("config does not contain %q:\n%s", want, data)
+				}
+			}
+
+			fs := testConfigFlagSet()
+			for _, name := range []string{"wg-private-key", "wg-public-key", "wg-address", "wg-provider", "wg-provider-account", "wg-provider-country", "tailscale-config-dir"} {
+				fs.String(name, "", "")
+			}
+			if err := applyConfigFile(fs, path); err != nil {
+				t.Errorf("generated config can't be loaded: %v", err)
+			}
+
+			unit, err := os.ReadFile(filepath.Join(filepath.Dir(path), "tsv.service"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(unit), "ExecStart=/usr/bin/tsv --config="+path) {
+				t.Errorf("unexpected systemd unit:\n%s", unit)
+			}
+		})
+	}
+}
+
+func TestRunInit_ExistingFile(t *testing.T) {
+	path := writeConfig(t, "tsv.yaml", "")
+	if err := RunInit(strings.NewReader(""), &strings.Builder{}, path, "tsv"); err == nil {
+		t.Error("expected an error when the config file already exists")
+	}
+}
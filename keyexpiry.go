@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+)
+
+var (
+	tsKeyExpiryWarning = flag.Duration("tailscale-key-expiry-warning", 14*24*time.Hour, "How long before the node key expires to start warning and attempting renewal")
+	tsLoginWebhook     = flag.String("tailscale-login-webhook", "", "URL to POST a JSON notification to when the node needs to be re-authenticated (disabled if empty)")
+)
+
+// MonitorKeyExpiry periodically checks when the Tailscale node key expires,
+// warning as expiry approaches and renewing the key if an OAuth client secret
+// is available to mint a new auth key
+func MonitorKeyExpiry(ctx context.Context, lc *local.Client) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		checkKeyExpiry(ctx, lc)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkKeyExpiry updates the key expiry metric and acts on an imminent expiry
+func checkKeyExpiry(ctx context.Context, lc *local.Client) {
+	status, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		slog.Warn("Failed to get Tailscale status", "error", err)
+		return
+	}
+
+	if status.Self == nil || status.Self.KeyExpiry == nil {
+		tailscaleKeyExpiry.Set(0)
+		return
+	}
+
+	expiry := *status.Self.KeyExpiry
+	tailscaleKeyExpiry.Set(float64(expiry.Unix()))
+
+	remaining := time.Until(expiry)
+	if remaining > *tsKeyExpiryWarning {
+		slog.Debug("Tailscale node key expiry", "expiry", expiry)
+		return
+	}
+
+	slog.Warn("Tailscale node key is expiring soon", "expiry", expiry, "remaining", remaining.Round(time.Minute))
+
+	if *tsOAuthClientSecret == "" {
+		slog.Warn("Re-authenticate the node or disable key expiry in the Tailscale admin console to avoid losing connectivity")
+		return
+	}
+
+	if err := renewNodeKey(ctx, lc); err != nil {
+		slog.Error("Failed to renew Tailscale node key", "error", err)
+	}
+}
+
+// renewNodeKey re-authenticates the node using a freshly minted auth key
+func renewNodeKey(ctx context.Context, lc *local.Client) error {
+	api, err := NewTailscaleAPI(ctx, *tsOAuthClientSecret)
+	if err != nil {
+		return err
+	}
+
+	ephemeral, preauthorized := authKeyOptions()
+	authKey, err := api.CreateAuthKey(ctx, parseTags(*tsTags), ephemeral, preauthorized)
+	if err != nil {
+		return err
+	}
+
+	if err := lc.Start(ctx, ipn.Options{AuthKey: authKey}); err != nil {
+		return fmt.Errorf("failed to restart with new auth key: %w", err)
+	}
+
+	if err := lc.StartLoginInteractive(ctx); err != nil {
+		return fmt.Errorf("failed to start login: %w", err)
+	}
+
+	slog.Info("Requested Tailscale node key renewal")
+	return nil
+}
+
+// loginNotification is the body sent to the login webhook
+type loginNotification struct {
+	Hostname string `json:"hostname"`
+	State    string `json:"state"`
+	LoginURL string `json:"login_url,omitempty"`
+}
+
+// loginWatcher reports when the node needs to be re-authenticated (e.g.
+// because its key has expired)
+type loginWatcher struct {
+	lc         *local.Client
+	needsLogin bool
+}
+
+// handle processes a notification from the IPN bus
+func (w *loginWatcher) handle(ctx context.Context, n ipn.Notify) {
+	if n.State != nil {
+		wasNeedsLogin := w.needsLogin
+		w.needsLogin = *n.State == ipn.NeedsLogin
+		if w.needsLogin {
+			tailscaleNeedsLogin.Set(1)
+		} else {
+			tailscaleNeedsLogin.Set(0)
+		}
+
+		if w.needsLogin && !wasNeedsLogin {
+			slog.Error("Tailscale node needs to be re-authenticated, connections from the tailnet will fail until it is")
+			notifyLogin(ctx, loginNotification{Hostname: *tsHostname, State: n.State.String()})
+			requestLogin(ctx, w.lc)
+		} else if !w.needsLogin && wasNeedsLogin {
+			slog.Info("Tailscale node is no longer waiting for login", "state", n.State.String())
+		}
+	}
+
+	if n.BrowseToURL != nil && w.needsLogin {
+		slog.Error("To re-authenticate the Tailscale node, visit the login URL", "url", *n.BrowseToURL)
+		notifyLogin(ctx, loginNotification{Hostname: *tsHostname, State: ipn.NeedsLogin.String(), LoginURL: *n.BrowseToURL})
+	}
+}
+
+// requestLogin renews the node key if possible, and otherwise starts an
+// interactive login so that a login URL is produced
+func requestLogin(ctx context.Context, lc *local.Client) {
+	if *tsOAuthClientSecret != "" {
+		if err := renewNodeKey(ctx, lc); err != nil {
+			slog.Error("Failed to renew Tailscale node key", "error", err)
+		}
+		return
+	}
+
+	if err := lc.StartLoginInteractive(ctx); err != nil {
+		slog.Error("Failed to start Tailscale login", "error", err)
+	}
+}
+
+// notifyLogin posts the notification to the login webhook, if one is set
+func notifyLogin(ctx context.Context, notification loginNotification) {
+	if *tsLoginWebhook == "" {
+		return
+	}
+
+	if err := postWebhook(ctx, *tsLoginWebhook, notification); err != nil {
+		slog.Error("Failed to call login webhook", "error", err)
+	}
+}
+
+// postWebhook sends the notification as JSON to url
+func postWebhook(ctx context.Context, url string, notification any) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
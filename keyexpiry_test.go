@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostWebhook(t *testing.T) {
+	var got loginNotification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	want := loginNotification{Hostname: "tsv", State: "NeedsLogin", LoginURL: "https://login.tailscale.com/a/abc123"}
+	if err := postWebhook(context.Background(), server.URL, want); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("webhook received %+v, want %+v", got, want)
+	}
+
+}
+
+func TestPostWebhookFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if err := postWebhook(context.Background(), server.URL, loginNotification{}); err == nil {
+		t.Error("expected an error for an unsuccessful response")
+	}
+}
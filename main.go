@@ -2,25 +2,106 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strings"
 	"syscall"
 
 	"github.com/csmith/envflag/v2"
 	"github.com/csmith/slogflags"
+	"tailscale.com/tailcfg"
 )
 
 func main() {
 	envflag.Parse()
+	explicit := explicitFlags(flag.CommandLine)
+
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			slog.Error("Failed to load config file", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := readSecretFiles(flag.CommandLine); err != nil {
+		slog.Error("Failed to read secret files", "error", err)
+		os.Exit(1)
+	}
+
 	slogflags.Logger(slogflags.WithSetDefault(true))
 
-	if err := validateFlags(); err != nil {
-		slog.Error("Flag validation failed", "error", err)
+	// Running without a command starts the node, as older versions did
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	if err := runCommand(name, args, explicit); err != nil {
+		slog.Error("Command failed", "command", name, "error", err)
 		os.Exit(1)
 	}
+}
 
+// runCommand runs the named subcommand
+func runCommand(name string, args []string, explicit map[string]bool) error {
+	switch name {
+	case "run":
+		return runUntilStopped(func(ctx context.Context) error {
+			return runNode(ctx, explicit)
+		})
+	case "service":
+		return RunService(args)
+	case "check":
+		return runCheck()
+	case "init":
+		path := "tsv.yaml"
+		if len(args) > 0 {
+			path = args[0]
+		}
+		binary, err := os.Executable()
+		if err != nil {
+			binary = "/usr/local/bin/tsv"
+		}
+		return RunInit(os.Stdin, os.Stdout, path, binary)
+	case "status":
+		return RunStatus(context.Background(), os.Stdout, *controlSocket, args)
+	case "control":
+		return RunControl(context.Background(), *controlSocket, args)
+	case "migrate":
+		return RunMigrate(os.Stdout, args)
+	case "genkey":
+		return runGenKey(os.Stdout)
+	case "version":
+		return runVersion(os.Stdout)
+	case "config":
+		if len(args) != 1 || args[0] != "dump" {
+			return fmt.Errorf("usage: tsv config dump")
+		}
+		return dumpConfig(os.Stdout, flag.CommandLine, explicit)
+	case "netcheck":
+		return RunNetcheck(context.Background(), os.Stdout, args)
+	case "export-state", "import-state":
+		var path string
+		if len(args) > 0 {
+			path = args[0]
+		}
+		return runStateCommand(name, path)
+	default:
+		return fmt.Errorf("unknown command %q (expected run, status, control, check, config, init, migrate, service, genkey, version, netcheck, export-state or import-state)", name)
+	}
+}
+
+// runWithSignals calls run with a context that is cancelled when the process
+// is interrupted or terminated
+func runWithSignals(run func(ctx context.Context) error) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -33,39 +114,344 @@ func main() {
 		cancel()
 	}()
 
+	return run(ctx)
+}
+
+// runNode starts the Tailscale node and proxies connections until ctx is
+// cancelled
+func runNode(ctx context.Context, explicit map[string]bool) error {
+	if err := validateFlags(); err != nil {
+		return fmt.Errorf("flag validation failed: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	slog.Info("Starting Tailscale VPN node...")
 
-	wgClient, err := NewWireGuardClient()
+	if *metricsAddress != "" {
+		listener, err := net.Listen("tcp", *metricsAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+		go ServeMetrics(ctx, listener)
+	}
+
+	var dialer Dialer
+	var wgClient *WireGuardClient
+	switch *upstream {
+	case "mock":
+		slog.Warn("Using mock upstream, traffic will be answered locally instead of being sent over WireGuard")
+		mock, err := NewMockDialer()
+		if err != nil {
+			return fmt.Errorf("failed to create mock upstream: %w", err)
+		}
+		defer mock.Close()
+		dialer = mock
+	case "ssh":
+		sshDialer, err := NewSSHDialer()
+		if err != nil {
+			return fmt.Errorf("failed to create SSH upstream: %w", err)
+		}
+		defer sshDialer.Close()
+		dialer = sshDialer
+	default:
+		var err error
+		wgClient, err = NewWireGuardClient()
+		if err != nil {
+			return fmt.Errorf("failed to create WireGuard client: %w", err)
+		}
+		defer wgClient.Close()
+		dialer = wgClient
+	}
+
+	proxy, err := NewProxy(dialer, ctx)
 	if err != nil {
-		slog.Error("Failed to create WireGuard client", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create proxy: %w", err)
+	}
+
+	var health HealthMonitor
+	if wgClient != nil {
+		health = wgClient
 	}
-	defer wgClient.Close()
 
-	proxy := NewProxy(wgClient, ctx)
+	var udpHandler UDPFlowHandler
+	if *udpForwarding {
+		udpHandler = proxy.HandleUDPFlow
+	}
 
-	ts, err := ConnectToTailscale(ctx, proxy.HandleConnection)
+	ts, advertiser, err := ConnectToTailscale(ctx, nodeHostname(ctx, dialer), proxy.HandleFlow, udpHandler, health)
 	if err != nil {
-		slog.Error("Failed to start Tailscale node", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to start Tailscale node: %w", err)
 	}
 	defer ts.Close()
 
 	slog.Info("Tailscale VPN node is running")
 
+	lc, err := ts.LocalClient()
+	if err != nil {
+		return fmt.Errorf("failed to get LocalClient: %w", err)
+	}
+	proxy.SetIdentityResolver(lc)
+
+	if *metricsTailnetAddress != "" {
+		listener, err := ts.Listen("tcp", *metricsTailnetAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics on the tailnet: %w", err)
+		}
+		go ServeMetrics(ctx, listener)
+	}
+
+	control := &ControlServer{proxy: proxy, wg: wgClient, lc: lc, routes: advertiser, explicit: explicit}
+	if magicsock, ok := ts.Sys().MagicSock.GetOK(); ok {
+		control.netcheck = magicsock.GetLastNetcheckReport
+	}
+
+	if *controlSocket != "" {
+		go func() {
+			if err := control.Serve(ctx, *controlSocket); err != nil {
+				slog.Error("Control interface failed", "error", err)
+			}
+		}()
+	}
+
+	if *adminAddress != "" {
+		listen := ts.Listen
+		if *adminTLS {
+			listen = ts.ListenTLS
+		}
+
+		listener, err := listen("tcp", *adminAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for admin API: %w", err)
+		}
+
+		allowed, err := parseSourceList(adminSources.String())
+		if err != nil {
+			return fmt.Errorf("invalid admin sources: %w", err)
+		}
+
+		go func() {
+			if err := control.ServeAdmin(ctx, listener, lc, allowed); err != nil {
+				slog.Error("Admin API failed", "error", err)
+			}
+		}()
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			slog.Info("Reloading config...")
+			if err := ReloadConfig(wgClient, explicit); err != nil {
+				slog.Error("Failed to reload config", "error", err)
+			}
+		}
+	}()
+
 	<-ctx.Done()
+	proxy.Drain(*shutdownGracePeriod)
+	if *tsEphemeral {
+		logoutEphemeralNode(lc)
+	}
 	slog.Info("Shutdown complete")
+	return nil
+}
+
+// runCheck validates the configuration, printing any problems found
+func runCheck() error {
+	if err := CheckConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return fmt.Errorf("configuration is invalid")
+	}
+	slog.Info("Configuration is valid")
+	return nil
+}
+
+// runGenKey prints a new WireGuard key pair
+func runGenKey(w io.Writer) error {
+	privateKey, publicKey, err := GenerateWireGuardKey()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Private key: %s\nPublic key:  %s\n", privateKey, publicKey)
+	return err
+}
+
+// runVersion prints the version of tsv and the Tailscale library it was
+// built with
+func runVersion(w io.Writer) error {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return fmt.Errorf("build information is not available")
+	}
+
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && (version == "" || version == "(devel)") {
+			version = setting.Value
+		}
+	}
+
+	tailscaleVersion := "unknown"
+	for _, dep := range info.Deps {
+		if dep.Path == "tailscale.com" {
+			tailscaleVersion = dep.Version
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "tsv %s (tailscale %s, %s)\n", version, tailscaleVersion, info.GoVersion)
+	return err
 }
 
 func validateFlags() error {
-	if *wgPrivateKey == "" {
-		return fmt.Errorf("--wg-private-key is required")
+	var errs []error
+	switch *upstream {
+	case "wireguard":
+		if *wgPrivateKey == "" {
+			errs = append(errs, fmt.Errorf("--wg-private-key is required"))
+		}
+		switch *wgProvider {
+		case "":
+			if *wgPublicKey == "" {
+				errs = append(errs, fmt.Errorf("--wg-public-key is required"))
+			}
+			if *wgEndpoint == "" {
+				errs = append(errs, fmt.Errorf("--wg-endpoint is required"))
+			}
+		case "mullvad":
+			if *wgProviderAccount == "" {
+				errs = append(errs, fmt.Errorf("--wg-provider-account is required when using --wg-provider"))
+			}
+			if *wgPublicKey != "" || *wgEndpoint != "" || *wgAddress != "" {
+				errs = append(errs, fmt.Errorf("--wg-public-key, --wg-endpoint and --wg-address can't be used with --wg-provider, which supplies them"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("--wg-provider must be 'mullvad'"))
+		}
+	case "ssh":
+		if *sshAddress == "" {
+			errs = append(errs, fmt.Errorf("--ssh-address is required"))
+		}
+		if *sshUser == "" {
+			errs = append(errs, fmt.Errorf("--ssh-user is required"))
+		}
+		if *sshPrivateKeyFile == "" {
+			errs = append(errs, fmt.Errorf("--ssh-private-key-file is required"))
+		}
+		if *sshHostKey == "" {
+			errs = append(errs, fmt.Errorf("--ssh-host-key is required"))
+		}
+		if *udpForwarding {
+			errs = append(errs, fmt.Errorf("--udp isn't supported with the ssh upstream"))
+		}
+	case "mock":
+	default:
+		errs = append(errs, fmt.Errorf("--upstream must be 'wireguard', 'ssh' or 'mock'"))
+	}
+	switch *logPrivacy {
+	case "off", "hash", "truncate":
+	default:
+		errs = append(errs, fmt.Errorf("--log-privacy must be 'off', 'hash' or 'truncate'"))
+	}
+	if *tsControlURL != "" {
+		if u, err := url.Parse(*tsControlURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("--tailscale-control-url must be an http or https URL"))
+		}
+	}
+	if *tsLoginWebhook != "" {
+		if u, err := url.Parse(*tsLoginWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("--tailscale-login-webhook must be an http or https URL"))
+		}
+	}
+	if routes, err := advertisedRoutes(tsExtraRoutes.String(), nil, *tsExitNode); err != nil {
+		errs = append(errs, err)
+	} else if len(routes) == 0 {
+		errs = append(errs, fmt.Errorf("--tailscale-extra-routes is required when not using --tailscale-exit-node"))
 	}
-	if *wgPublicKey == "" {
-		return fmt.Errorf("--wg-public-key is required")
+	if _, err := parsePrefixSet(excludeIPs.String()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid excluded IPs: %w", err))
 	}
-	if *wgEndpoint == "" {
-		return fmt.Errorf("--wg-endpoint is required")
+	if _, err := parseSourceList(allowSources.String()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid allowed sources: %w", err))
+	}
+	if _, err := parseSourcePolicies(sourcePolicyRules.String()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid source policies: %w", err))
+	}
+	if sources, err := parseSourceList(adminSources.String()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid admin sources: %w", err))
+	} else if *adminAddress != "" && len(sources) == 0 {
+		errs = append(errs, fmt.Errorf("--admin-sources is required when using --admin-address"))
+	}
+	if *adminTLS && *adminAddress == "" {
+		errs = append(errs, fmt.Errorf("--admin-address is required when using --admin-tls"))
+	}
+	for _, tag := range parseTags(*tsTags) {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tag %s: %w", tag, err))
+		}
+	}
+	switch *tsHostnameSuffix {
+	case "", "country":
+	case "provider":
+		if *wgProvider == "" {
+			errs = append(errs, fmt.Errorf("--wg-provider is required when using --tailscale-hostname-suffix=provider"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("--tailscale-hostname-suffix must be 'provider' or 'country'"))
+	}
+	if *standbyFor != "" && strings.EqualFold(*standbyFor, *tsHostname) {
+		errs = append(errs, fmt.Errorf("--standby-for must name another node, not this one"))
+	}
+	if _, err := parseDestinations(proxyProtocolDestinations.String()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid PROXY protocol destinations: %w", err))
+	}
+	if *copyBufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("--copy-buffer-size must be positive"))
+	}
+	switch *connectionLimitPolicy {
+	case "reject", "queue":
+	default:
+		errs = append(errs, fmt.Errorf("--connection-limit-policy must be 'reject' or 'queue'"))
+	}
+	if _, err := parseBandwidth(*rateLimit); err != nil {
+		errs = append(errs, fmt.Errorf("invalid rate limit: %w", err))
+	}
+	if _, err := parseBandwidth(*rateLimitPerConn); err != nil {
+		errs = append(errs, fmt.Errorf("invalid per-connection rate limit: %w", err))
+	}
+	if *tsEncryptState && (*tsConfigDir == "" || *statePassphrase == "") {
+		errs = append(errs, fmt.Errorf("--tailscale-config-dir and --state-passphrase are required when using --tailscale-encrypt-state"))
+	}
+	if *tsAutoApproveRoutes && *tsAPIKey == "" && *tsOAuthClientSecret == "" {
+		errs = append(errs, fmt.Errorf("--tailscale-api-key or --tailscale-oauth-client-secret is required when using --tailscale-auto-approve-routes"))
+	}
+	if *tsOAuthClientSecret != "" && len(parseTags(*tsTags)) == 0 {
+		errs = append(errs, fmt.Errorf("--tailscale-tags is required when using --tailscale-oauth-client-secret"))
+	}
+	return errors.Join(errs...)
+}
+
+func runStateCommand(command, path string) error {
+	if path == "" {
+		return fmt.Errorf("usage: tsv %s <archive>", command)
+	}
+	if *tsConfigDir == "" {
+		return fmt.Errorf("--tailscale-config-dir is required")
+	}
+
+	if command == "export-state" {
+		if err := ExportState(*tsConfigDir, path, *statePassphrase); err != nil {
+			return err
+		}
+		slog.Info("Exported tsnet state", "dir", *tsConfigDir, "archive", path)
+		return nil
+	}
+
+	if err := ImportState(path, *tsConfigDir, *statePassphrase); err != nil {
+		return err
 	}
+	slog.Info("Imported tsnet state", "dir", *tsConfigDir, "archive", path)
 	return nil
 }
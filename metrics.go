@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"tailscale.com/util/usermetric"
+)
+
+var (
+	metricsAddress        = flag.String("metrics-address", "", "Address on the host to serve Prometheus metrics on (e.g. :9090; disabled if empty)")
+	metricsTailnetAddress = flag.String("metrics-tailnet-address", "", "Address on the node's Tailscale IPs to serve Prometheus metrics on (e.g. :9090; disabled if empty)")
+	metricsPerSource      = flag.Bool("metrics-per-source", false, "Break down connection and byte metrics by tailnet source address, obscured according to --log-privacy (adds series for every source)")
+)
+
+var (
+	tailscaleKeyExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsv_tailscale_key_expiry_timestamp_seconds",
+		Help: "Unix time at which the Tailscale node key expires (0 if expiry is disabled)",
+	})
+	tailscaleUnapprovedRoutes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsv_tailscale_unapproved_routes",
+		Help: "Number of advertised routes that are waiting to be approved in the Tailscale admin console",
+	})
+	tailscaleNeedsLogin = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsv_tailscale_needs_login",
+		Help: "Whether the Tailscale node needs to be re-authenticated (1) or not (0)",
+	})
+)
+
+var (
+	proxyConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsv_proxy_connections_total",
+		Help: "Number of connections and UDP flows proxied, by protocol ('tcp' or 'udp'), destination port and tailnet source address (if --metrics-per-source is set)",
+	}, []string{"protocol", "port", "source"})
+	proxyBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsv_proxy_bytes_total",
+		Help: "Bytes proxied, by direction ('sent' to destinations or 'received' from them), protocol ('tcp' or 'udp'), destination port and tailnet source address (if --metrics-per-source is set)",
+	}, []string{"direction", "protocol", "port", "source"})
+	proxyConnectionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tsv_proxy_connection_duration_seconds",
+		Help:    "How long proxied connections and UDP flows stayed open, by protocol and destination port",
+		Buckets: []float64{0.1, 1, 10, 60, 300, 1800, 3600, 14400, 86400},
+	}, []string{"protocol", "port"})
+	proxyDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tsv_proxy_dial_duration_seconds",
+		Help:    "How long it took to connect to destinations via the upstream, by protocol and destination port",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"protocol", "port"})
+)
+
+// metricsSource returns the value of the source label for connections from
+// src, which is empty unless --metrics-per-source is set
+func metricsSource(src netip.Addr) string {
+	if !*metricsPerSource {
+		return ""
+	}
+	return redactAddr(src, *logPrivacy, *logPrivacySalt)
+}
+
+// tailscaleUserMetrics holds tsnet's user-facing metrics, once the node is
+// running
+var tailscaleUserMetrics atomic.Pointer[usermetric.Registry]
+
+// userMetricsGatherer gathers tsnet's user-facing metrics (the same ones
+// tailscaled exposes), which are only available in the Prometheus text format
+type userMetricsGatherer struct{}
+
+func (userMetricsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	registry := tailscaleUserMetrics.Load()
+	if registry == nil {
+		return nil, nil
+	}
+
+	w := &bufferResponseWriter{header: make(http.Header)}
+	registry.Handler(w, &http.Request{})
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(&w.body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Tailscale user metrics: %w", err)
+	}
+
+	res := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		res = append(res, family)
+	}
+	slices.SortFunc(res, func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return res, nil
+}
+
+// bufferResponseWriter is a minimal http.ResponseWriter that buffers the body
+type bufferResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *bufferResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferResponseWriter) WriteHeader(int) {}
+
+// expvarCollector exports a map of Tailscale-style expvars, whose names are
+// prefixed with "counter_" or "gauge_", as Prometheus metrics
+type expvarCollector struct {
+	prefix string
+	vars   interface{ Do(func(expvar.KeyValue)) }
+}
+
+func (c *expvarCollector) Describe(chan<- *prometheus.Desc) {
+	// Unchecked collector: the set of vars isn't known up front
+}
+
+func (c *expvarCollector) Collect(ch chan<- prometheus.Metric) {
+	c.vars.Do(func(kv expvar.KeyValue) {
+		value, err := strconv.ParseFloat(kv.Value.String(), 64)
+		if err != nil {
+			return
+		}
+
+		var name string
+		var valueType prometheus.ValueType
+		if n, ok := strings.CutPrefix(kv.Key, "counter_"); ok {
+			name, valueType = n+"_total", prometheus.CounterValue
+		} else if n, ok := strings.CutPrefix(kv.Key, "gauge_"); ok {
+			name, valueType = n, prometheus.GaugeValue
+		} else {
+			return
+		}
+
+		desc := prometheus.NewDesc(c.prefix+name, "Tailscale metric "+kv.Key, nil, nil)
+		ch <- prometheus.MustNewConstMetric(desc, valueType, value)
+	})
+}
+
+// ServeMetrics serves Prometheus metrics on listener until the context is
+// cancelled
+func ServeMetrics(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, userMetricsGatherer{}}
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})))
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	slog.Info("Serving metrics", "address", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Metrics server failed", "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"expvar"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/util/usermetric"
+)
+
+func TestExpvarCollector(t *testing.T) {
+	vars := new(expvar.Map)
+	dropped := new(expvar.Int)
+	dropped.Set(3)
+	vars.Set("counter_dropped_packets", dropped)
+	vars.Set("gauge_tcp_forward_in_flight", expvar.Func(func() any { return 7 }))
+	vars.Set("ignored", expvar.Func(func() any { return 1 }))
+	vars.Set("gauge_not_a_number", expvar.Func(func() any { return "nope" }))
+
+	collector := &expvarCollector{prefix: "test_", vars: vars}
+
+	want := `
+# HELP test_dropped_packets_total Tailscale metric counter_dropped_packets
+# TYPE test_dropped_packets_total counter
+test_dropped_packets_total 3
+# HELP test_tcp_forward_in_flight Tailscale metric gauge_tcp_forward_in_flight
+# TYPE test_tcp_forward_in_flight gauge
+test_tcp_forward_in_flight 7
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUserMetricsGatherer(t *testing.T) {
+	registry := new(usermetric.Registry)
+	registry.NewGauge("tailscaled_test_gauge", "A test gauge").Set(42)
+	requests := usermetric.NewMultiLabelMapWithRegistry[testLabels](registry, "tailscaled_test_requests_total", "counter", "Test requests")
+	requests.Add(testLabels{Path: "direct"}, 3)
+
+	tailscaleUserMetrics.Store(registry)
+	defer tailscaleUserMetrics.Store(nil)
+
+	want := `
+# HELP tailscaled_test_gauge A test gauge
+# TYPE tailscaled_test_gauge gauge
+tailscaled_test_gauge 42
+# HELP tailscaled_test_requests_total Test requests
+# TYPE tailscaled_test_requests_total counter
+tailscaled_test_requests_total{path="direct"} 3
+`
+	if err := testutil.GatherAndCompare(userMetricsGatherer{}, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+type testLabels struct {
+	Path string
+}
+
+func TestMetricsSource(t *testing.T) {
+	src := netip.MustParseAddr("100.64.0.2")
+	defer func(perSource bool, privacy string) {
+		*metricsPerSource = perSource
+		*logPrivacy = privacy
+	}(*metricsPerSource, *logPrivacy)
+
+	tests := []struct {
+		perSource bool
+		privacy   string
+		want      string
+	}{
+		{perSource: false, privacy: "off", want: ""},
+		{perSource: true, privacy: "off", want: "100.64.0.2"},
+		{perSource: true, privacy: "truncate", want: "100.64.0.0/24"},
+	}
+
+	for _, tt := range tests {
+		*metricsPerSource = tt.perSource
+		*logPrivacy = tt.privacy
+		if got := metricsSource(src); got != tt.want {
+			t.Errorf("metricsSource() with per-source %v and privacy %s = %q, want %q", tt.perSource, tt.privacy, got, tt.want)
+		}
+	}
+}
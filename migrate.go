@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// RunMigrate converts a wg-quick config file, and the routes currently
+// advertised by a subnet router, into a tsv config file written to w
+func RunMigrate(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	routes := &listValue{}
+	fs.Var(routes, "routes", "Routes advertised by the existing subnet router (comma-separated, may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: tsv migrate [--routes=<prefixes>] <wg-quick config>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open wg-quick config: %w", err)
+	}
+	defer f.Close()
+
+	cfg, err := parseWGQuickConfig(f)
+	if err != nil {
+		return err
+	}
+
+	// The default routes are advertised by the exit node setting rather than
+	// as extra routes, so the node is only an exit node if the old router was
+	var extra []string
+	exitNode := false
+	for _, route := range strings.Split(routes.String(), ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		prefix, err := parsePrefixOrAddr(route)
+		if err != nil {
+			return fmt.Errorf("invalid route %s: %w", route, err)
+		}
+		if prefix.Bits() == 0 {
+			exitNode = true
+		} else {
+			extra = append(extra, prefix.String())
+		}
+	}
+	cfg.Tailscale.ExtraRoutes = strings.Join(extra, ",")
+	if routes.set {
+		cfg.Tailscale.ExitNode = &exitNode
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// parseWGQuickConfig reads the settings tsv supports from a wg-quick config
+// file, which must contain a single peer
+func parseWGQuickConfig(r io.Reader) (*generatedConfig, error) {
+	cfg := &generatedConfig{}
+	var section string
+	peers := 0
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.ToLower(strings.Trim(text, "[]"))
+			if section == "peer" {
+				peers++
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch section + "." + key {
+		case "interface.privatekey":
+			cfg.WG.PrivateKey = value
+		case "interface.address":
+			cfg.WG.Address = appendList(cfg.WG.Address, value)
+		case "interface.dns":
+			// wg-quick allows search domains here, which tsv doesn't use
+			for _, entry := range strings.Split(value, ",") {
+				entry = strings.TrimSpace(entry)
+				if _, err := netip.ParseAddr(entry); err == nil {
+					cfg.WG.DNS = appendList(cfg.WG.DNS, entry)
+				}
+			}
+		case "interface.mtu":
+			mtu, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid MTU: %w", line, err)
+			}
+			cfg.WG.MTU = mtu
+		case "peer.publickey":
+			cfg.WG.PublicKey = value
+		case "peer.presharedkey":
+			cfg.WG.PresharedKey = value
+		case "peer.endpoint":
+			cfg.WG.Endpoint = value
+		case "peer.allowedips":
+			cfg.WG.AllowedIPs = appendList(cfg.WG.AllowedIPs, value)
+		default:
+			slog.Warn("Ignoring unsupported wg-quick setting", "line", line, "setting", key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read wg-quick config: %w", err)
+	}
+
+	if peers != 1 {
+		return nil, fmt.Errorf("wg-quick config must have exactly one peer, found %d", peers)
+	}
+	if cfg.WG.PrivateKey == "" {
+		return nil, fmt.Errorf("wg-quick config has no private key")
+	}
+	return cfg, nil
+}
+
+// appendList adds a comma-separated value to a comma-separated list
+func appendList(list, value string) string {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if list != "" {
+			list += ","
+		}
+		list += entry
+	}
+	return list
+}
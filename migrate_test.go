@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testWGQuickConfig = `
+[Interface]
+# Client
+PrivateKey = YJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=
+Address = 10.64.0.2/32
+Address = fc00:bbbb::2/128
+DNS = 10.64.0.1, example.internal
+MTU = 1380
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = ZJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 192.0.2.1:51820
+`
+
+func TestRunMigrate(t *testing.T) {
+	path := writeConfig(t, "wg0.conf", testWGQuickConfig)
+
+	var out strings.Builder
+	if err := RunMigrate(&out, []string{"--routes=0.0.0.0/0,::/0,10.1.0.0/16", "--routes", "192.168.1.0/24", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `wg:
+    private-key: YJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=
+    public-key: ZJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=
+    endpoint: 192.0.2.1:51820
+    allowed-ips: 0.0.0.0/0,::/0
+    address: 10.64.0.2/32,fc00:bbbb::2/128
+    dns: 10.64.0.1
+    mtu: 1380
+tailscale:
+    extra-routes: 10.1.0.0/16,192.168.1.0/24
+    exit-node: true
+`
+	if out.String() != want {
+		t.Errorf("RunMigrate() =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	fs := testConfigFlagSet()
+	for _, name := range []string{"wg-private-key", "wg-public-key", "wg-allowed-ips", "wg-address", "tailscale-extra-routes"} {
+		fs.String(name, "", "")
+	}
+	fs.Bool("tailscale-exit-node", true, "")
+	migrated := writeConfig(t, "tsv.yaml", out.String())
+	if err := applyConfigFile(fs, migrated); err != nil {
+		t.Errorf("migrated config can't be loaded: %v", err)
+	}
+}
+
+func TestRunMigrateExitNode(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+		want   string
+	}{
+		{name: "no routes given", want: ""},
+		{name: "exit node", routes: "--routes=0.0.0.0/0,::/0", want: "tailscale:\n    exit-node: true\n"},
+		{name: "subnet router", routes: "--routes=10.1.0.0/16", want: "tailscale:\n    extra-routes: 10.1.0.0/16\n    exit-node: false\n"},
+	}
+
+	path := writeConfig(t, "wg0.conf", testWGQuickConfig)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{path}
+			if tt.routes != "" {
+				args = []string{tt.routes, path}
+			}
+
+			var out strings.Builder
+			if err := RunMigrate(&out, args); err != nil {
+				t.Fatal(err)
+			}
+
+			_, tailscale, _ := strings.Cut(out.String(), "tailscale:\n")
+			if tt.want == "" {
+				if tailscale != "" {
+					t.Errorf("RunMigrate() tailscale section = %q, want none", tailscale)
+				}
+			} else if got := "tailscale:\n" + tailscale; got != tt.want {
+				t.Errorf("RunMigrate() tailscale section =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWGQuickConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "no peers",
+			content: "[Interface]\nPrivateKey = abc=\n",
+			wantErr: "exactly one peer, found 0",
+		},
+		{
+			name:    "multiple peers",
+			content: "[Interface]\nPrivateKey = abc=\n[Peer]\nPublicKey = a=\n[Peer]\nPublicKey = b=\n",
+			wantErr: "exactly one peer, found 2",
+		},
+		{
+			name:    "no private key",
+			content: "[Peer]\nPublicKey = a=\n",
+			wantErr: "no private key",
+		},
+		{
+			name:    "invalid line",
+			content: "[Interface]\nPrivateKey\n",
+			wantErr: "line 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseWGQuickConfig(strings.NewReader(tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseWGQuickConfig() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
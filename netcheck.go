@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/eventbus"
+)
+
+// RunNetcheck runs a Tailscale netcheck from this host and writes the report
+// to w, either in a human-readable form or as JSON
+func RunNetcheck(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("netcheck", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Output the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	bus := eventbus.New()
+	defer bus.Close()
+
+	netMon, err := netmon.New(bus, logger.Discard)
+	if err != nil {
+		return err
+	}
+
+	client := &netcheck.Client{
+		NetMon: netMon,
+		Logf:   logger.Discard,
+	}
+	if err := client.Standalone(ctx, ":0"); err != nil {
+		slog.Warn("Netcheck UDP test failed", "error", err)
+	}
+
+	dm, err := fetchDERPMap(ctx, cmp.Or(*tsControlURL, ipn.DefaultControlURL))
+	if err != nil {
+		return err
+	}
+
+	report, err := client.GetReport(ctx, dm, nil)
+	if err != nil {
+		return fmt.Errorf("netcheck failed: %w", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	printNetcheckReport(w, dm, report)
+	return nil
+}
+
+// fetchDERPMap retrieves the default DERP map from the control server
+func fetchDERPMap(ctx context.Context, controlURL string) (*tailcfg.DERPMap, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(controlURL, "/")+"/derpmap/default", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch DERP map: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch DERP map: unexpected status %d", resp.StatusCode)
+	}
+
+	dm := &tailcfg.DERPMap{}
+	if err := json.NewDecoder(resp.Body).Decode(dm); err != nil {
+		return nil, fmt.Errorf("failed to decode DERP map: %w", err)
+	}
+	return dm, nil
+}
+
+// printNetcheckReport writes a human-readable summary of a netcheck report
+func printNetcheckReport(w io.Writer, dm *tailcfg.DERPMap, report *netcheck.Report) {
+	fmt.Fprintf(w, "UDP: %v\n", report.UDP)
+	if report.GlobalV4.IsValid() {
+		fmt.Fprintf(w, "IPv4: %s\n", report.GlobalV4)
+	} else {
+		fmt.Fprintf(w, "IPv4: no address found\n")
+	}
+	if report.GlobalV6.IsValid() {
+		fmt.Fprintf(w, "IPv6: %s\n", report.GlobalV6)
+	} else {
+		fmt.Fprintf(w, "IPv6: no address found\n")
+	}
+	fmt.Fprintf(w, "Mapping varies by destination IP (hard NAT): %v\n", report.MappingVariesByDestIP)
+	fmt.Fprintf(w, "Port mapping: UPnP=%v NAT-PMP=%v PCP=%v\n", report.UPnP, report.PMP, report.PCP)
+
+	if region, ok := dm.Regions[report.PreferredDERP]; ok {
+		fmt.Fprintf(w, "Nearest DERP: %s\n", region.RegionName)
+	} else {
+		fmt.Fprintf(w, "Nearest DERP: unknown\n")
+	}
+
+	var regions []int
+	for id := range report.RegionLatency {
+		regions = append(regions, id)
+	}
+	slices.SortFunc(regions, func(a, b int) int {
+		return cmp.Compare(report.RegionLatency[a], report.RegionLatency[b])
+	})
+
+	fmt.Fprintf(w, "DERP latency:\n")
+	for _, id := range regions {
+		if region, ok := dm.Regions[id]; ok {
+			fmt.Fprintf(w, "  %-5s %-8s (%s)\n", region.RegionCode, report.RegionLatency[id].Round(time.Millisecond/10), region.RegionName)
+		}
+	}
+}
+
+// NetcheckStatus summarises a running node's most recent netcheck report
+type NetcheckStatus struct {
+	UDP           bool           `json:"udp"`
+	IPv4          netip.AddrPort `json:"ipv4"`
+	IPv6          netip.AddrPort `json:"ipv6"`
+	HardNAT       bool           `json:"hard_nat"`
+	UPnP          bool           `json:"upnp"`
+	PMP           bool           `json:"pmp"`
+	PCP           bool           `json:"pcp"`
+	PreferredDERP string         `json:"preferred_derp"`
+	DERPLatency   []DERPLatency  `json:"derp_latency"`
+}
+
+// DERPLatency is the latency from the node to a DERP region
+type DERPLatency struct {
+	Code    string        `json:"code"`
+	Name    string        `json:"name"`
+	Latency time.Duration `json:"latency"`
+}
+
+// netcheckStatus summarises a netcheck report, naming regions from dm and
+// ordering them by latency
+func netcheckStatus(dm *tailcfg.DERPMap, report *netcheck.Report) *NetcheckStatus {
+	status := &NetcheckStatus{
+		UDP:     report.UDP,
+		IPv4:    report.GlobalV4,
+		IPv6:    report.GlobalV6,
+		HardNAT: report.MappingVariesByDestIP.EqualBool(true),
+		UPnP:    report.UPnP.EqualBool(true),
+		PMP:     report.PMP.EqualBool(true),
+		PCP:     report.PCP.EqualBool(true),
+	}
+
+	if region, ok := dm.Regions[report.PreferredDERP]; ok {
+		status.PreferredDERP = region.RegionName
+	}
+
+	for id, latency := range report.RegionLatency {
+		if region, ok := dm.Regions[id]; ok {
+			status.DERPLatency = append(status.DERPLatency, DERPLatency{Code: region.RegionCode, Name: region.RegionName, Latency: latency})
+		}
+	}
+	slices.SortFunc(status.DERPLatency, func(a, b DERPLatency) int {
+		return cmp.Or(cmp.Compare(a.Latency, b.Latency), cmp.Compare(a.Code, b.Code))
+	})
+
+	return status
+}
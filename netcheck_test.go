@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestFetchDERPMap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/derpmap/default" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&tailcfg.DERPMap{
+			Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1, RegionCode: "test"}},
+		})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		controlURL string
+		wantErr    bool
+	}{
+		{name: "control URL", controlURL: server.URL},
+		{name: "trailing slash", controlURL: server.URL + "/"},
+		{name: "not found", controlURL: server.URL + "/missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm, err := fetchDERPMap(context.Background(), tt.controlURL)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("fetchDERPMap() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchDERPMap() error = %v", err)
+			}
+			if region := dm.Regions[1]; region == nil || region.RegionCode != "test" {
+				t.Errorf("fetchDERPMap() regions = %v, want the server's map", dm.Regions)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var (
+	dialTimeout          = flag.Duration("dial-timeout", 10*time.Second, "Timeout for connecting to destinations")
+	dialTimeoutOverrides = flag.String("dial-timeout-overrides", "", "Per-destination dial timeouts (comma-separated prefix=duration, e.g. 203.0.113.0/24=2s)")
+	maxLifetime          = flag.Duration("max-lifetime", 0, "Maximum lifetime of proxied connections (0 for unlimited)")
+	maxLifetimeOverrides = flag.String("max-lifetime-overrides", "", "Per-destination maximum connection lifetimes (comma-separated prefix=duration, 0 for unlimited)")
+)
+
+// prefixDuration associates a duration with a destination prefix
+type prefixDuration struct {
+	prefix   netip.Prefix
+	duration time.Duration
+}
+
+// prefixDurations is a set of per-destination duration overrides
+type prefixDurations []prefixDuration
+
+// parsePrefixDurations parses a comma-separated list of prefix=duration pairs.
+// Bare IP addresses are treated as single-address prefixes.
+func parsePrefixDurations(s string) (prefixDurations, error) {
+	var res prefixDurations
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefixStr, durationStr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid override %s: expected prefix=duration", entry)
+		}
+
+		prefix, err := parsePrefixOrAddr(strings.TrimSpace(prefixStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %s: %w", entry, err)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(durationStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %s: %w", entry, err)
+		}
+
+		res = append(res, prefixDuration{prefix: prefix, duration: duration})
+	}
+	return res, nil
+}
+
+// lookup returns the duration for the most specific prefix containing addr,
+// or def if there is no matching override
+func (p prefixDurations) lookup(addr netip.Addr, def time.Duration) time.Duration {
+	addr = addr.Unmap()
+	best := -1
+	res := def
+	for _, o := range p {
+		if o.prefix.Bits() > best && o.prefix.Contains(addr) {
+			best = o.prefix.Bits()
+			res = o.duration
+		}
+	}
+	return res
+}
+
+// parsePrefixOrAddr parses a CIDR prefix, or a bare IP address as a
+// single-address prefix
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
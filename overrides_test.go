@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParsePrefixDurations(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:  "empty string",
+			input: "",
+			want:  0,
+		},
+		{
+			name:  "prefixes and addresses",
+			input: "203.0.113.0/24=2s, 198.51.100.7=1m, 2001:db8::/32=0",
+			want:  3,
+		},
+		{
+			name:    "missing duration",
+			input:   "203.0.113.0/24",
+			wantErr: true,
+		},
+		{
+			name:    "invalid prefix",
+			input:   "not-a-prefix=2s",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			input:   "203.0.113.0/24=soon",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePrefixDurations(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePrefixDurations() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("parsePrefixDurations() got %d overrides, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixDurationsLookup(t *testing.T) {
+	overrides, err := parsePrefixDurations("203.0.113.0/24=2s, 203.0.113.128/25=3s, 203.0.113.200=0, 2001:db8::/32=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want time.Duration
+	}{
+		{"198.51.100.1", 10 * time.Second},
+		{"203.0.113.1", 2 * time.Second},
+		{"203.0.113.129", 3 * time.Second},
+		{"203.0.113.200", 0},
+		{"::ffff:203.0.113.1", 2 * time.Second},
+		{"2001:db8::1", time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := overrides.lookup(netip.MustParseAddr(tt.addr), 10*time.Second); got != tt.want {
+				t.Errorf("lookup(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	logPrivacy     = flag.String("log-privacy", "off", "How to obscure destination addresses in logs and metrics ('off', 'hash' or 'truncate')")
+	logPrivacySalt = flag.String("log-privacy-salt", "", "Salt to use when hashing destination addresses")
+)
+
+// redactAddrPort obscures the address part of addr according to the given
+// privacy mode. Hashing replaces the address with a salted HMAC, so the same
+// destination can still be correlated across log lines; truncating keeps only
+// the /24 (IPv4) or /48 (IPv6) network. Ports are always kept.
+func redactAddrPort(addr netip.AddrPort, mode, salt string) string {
+	if mode != "hash" && mode != "truncate" {
+		return addr.String()
+	}
+	return redactAddr(addr.Addr(), mode, salt) + ":" + strconv.Itoa(int(addr.Port()))
+}
+
+// redactAddr obscures addr in the same way as redactAddrPort
+func redactAddr(addr netip.Addr, mode, salt string) string {
+	switch mode {
+	case "hash":
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write(addr.AsSlice())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	case "truncate":
+		bits := 24
+		if addr.Is6() && !addr.Is4In6() {
+			bits = 48
+		}
+		prefix, _ := addr.Unmap().Prefix(bits)
+		return prefix.String()
+	default:
+		return addr.String()
+	}
+}
+
+// redactError returns the message of err with any occurrences of addr
+// obscured in the same way as redactAddrPort
+func redactError(err error, addr netip.AddrPort, mode, salt string) string {
+	if mode == "off" {
+		return err.Error()
+	}
+	msg := strings.ReplaceAll(err.Error(), addr.String(), redactAddrPort(addr, mode, salt))
+	return strings.ReplaceAll(msg, addr.Addr().String(), redactAddrPort(addr, mode, salt))
+}
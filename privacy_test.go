@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRedactAddrPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		mode  string
+		want  string
+	}{
+		{
+			name:  "off",
+			input: "203.0.113.45:443",
+			mode:  "off",
+			want:  "203.0.113.45:443",
+		},
+		{
+			name:  "truncate IPv4",
+			input: "203.0.113.45:443",
+			mode:  "truncate",
+			want:  "203.0.113.0/24:443",
+		},
+		{
+			name:  "truncate IPv6",
+			input: "[2001:db8:1234:5678::1]:443",
+			mode:  "truncate",
+			want:  "2001:db8:1234::/48:443",
+		},
+		{
+			name:  "truncate IPv4-mapped IPv6",
+			input: "[::ffff:203.0.113.45]:80",
+			mode:  "truncate",
+			want:  "203.0.113.0/24:80",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactAddrPort(netip.MustParseAddrPort(tt.input), tt.mode, "salt")
+			if got != tt.want {
+				t.Errorf("redactAddrPort() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactAddrPortHash(t *testing.T) {
+	addr := netip.MustParseAddrPort("203.0.113.45:443")
+
+	got := redactAddrPort(addr, "hash", "salt")
+	if strings.Contains(got, "203.0.113") || !strings.HasSuffix(got, ":443") {
+		t.Errorf("redactAddrPort() = %q, want hashed address with port", got)
+	}
+	if again := redactAddrPort(addr, "hash", "salt"); again != got {
+		t.Errorf("redactAddrPort() not stable: %q != %q", again, got)
+	}
+	if other := redactAddrPort(addr, "hash", "pepper"); other == got {
+		t.Errorf("redactAddrPort() ignored salt: %q", other)
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	addr := netip.MustParseAddrPort("203.0.113.45:443")
+	err := errors.New("dial tcp 203.0.113.45:443: connect: connection refused")
+
+	got := redactError(err, addr, "truncate", "")
+	if want := "dial tcp 203.0.113.0/24:443: connect: connection refused"; got != want {
+		t.Errorf("redactError() = %q, want %q", got, want)
+	}
+}
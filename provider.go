@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	wgProvider            = flag.String("wg-provider", "", "VPN provider to fetch the WireGuard peer configuration from instead of --wg-public-key, --wg-endpoint and --wg-address (supported: mullvad)")
+	wgProviderAccount     = flag.String("wg-provider-account", "", "Account number for --wg-provider")
+	wgProviderAccountFile = flag.String("wg-provider-account-file", "", "Path to a file containing the account number for --wg-provider (alternative to --wg-provider-account)")
+	wgProviderCountry     = flag.String("wg-provider-country", "", "Country code to pick --wg-provider servers from (e.g. se; any country if blank)")
+)
+
+// Provider fetches WireGuard peer configuration from a VPN provider's API
+type Provider interface {
+	// SelectServer picks a server to connect to
+	SelectServer(ctx context.Context) (wireGuardServer, error)
+
+	// RegisterKey ensures that publicKey is registered with the account, and
+	// returns the interface addresses assigned to it
+	RegisterKey(ctx context.Context, publicKey string) (string, error)
+}
+
+// NewProvider creates the provider named by --wg-provider
+func NewProvider() (Provider, error) {
+	switch *wgProvider {
+	case "mullvad":
+		return &MullvadProvider{
+			client:  http.DefaultClient,
+			baseURL: "https://api.mullvad.net",
+			account: *wgProviderAccount,
+			country: *wgProviderCountry,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported VPN provider %q", *wgProvider)
+	}
+}
+
+// configureFromProvider fills in the peer and interface addresses of cfg
+// using the provider configured by --wg-provider
+func configureFromProvider(ctx context.Context, cfg *WireGuardConfig) error {
+	provider, err := NewProvider()
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := wireGuardPublicKey(cfg.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	addresses, err := provider.RegisterKey(ctx, publicKey)
+	if err != nil {
+		return err
+	}
+
+	server, err := provider.SelectServer(ctx)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Fetched WireGuard configuration from provider", "provider", *wgProvider, "endpoint", server.Endpoint, "address", addresses)
+	cfg.PeerPublicKey = server.PublicKey
+	cfg.Endpoint = server.Endpoint
+	cfg.Address = addresses
+	return nil
+}
+
+// MullvadProvider fetches WireGuard configuration from Mullvad's API
+type MullvadProvider struct {
+	client  *http.Client
+	baseURL string
+	account string
+	country string
+
+	tokenMutex sync.Mutex
+	token      string
+}
+
+type mullvadRelay struct {
+	Hostname    string `json:"hostname"`
+	CountryCode string `json:"country_code"`
+	Active      bool   `json:"active"`
+	IPv4AddrIn  string `json:"ipv4_addr_in"`
+	PublicKey   string `json:"pubkey"`
+}
+
+type mullvadDevice struct {
+	PublicKey   string `json:"pubkey"`
+	IPv4Address string `json:"ipv4_address"`
+	IPv6Address string `json:"ipv6_address"`
+}
+
+// SelectServer picks a random active relay, from the configured country if any
+func (m *MullvadProvider) SelectServer(ctx context.Context) (wireGuardServer, error) {
+	var relays []mullvadRelay
+	if err := m.do(ctx, http.MethodGet, "/www/relays/wireguard/", false, nil, &relays); err != nil {
+		return wireGuardServer{}, fmt.Errorf("failed to list Mullvad relays: %w", err)
+	}
+
+	var candidates []mullvadRelay
+	for _, relay := range relays {
+		if relay.Active && relay.IPv4AddrIn != "" && (m.country == "" || strings.EqualFold(relay.CountryCode, m.country)) {
+			candidates = append(candidates, relay)
+		}
+	}
+	if len(candidates) == 0 {
+		return wireGuardServer{}, fmt.Errorf("no active Mullvad relays found in country %q", m.country)
+	}
+
+	relay := candidates[rand.IntN(len(candidates))]
+	slog.Debug("Selected Mullvad relay", "hostname", relay.Hostname)
+	return wireGuardServer{
+		PublicKey: relay.PublicKey,
+		Endpoint:  net.JoinHostPort(relay.IPv4AddrIn, "51820"),
+	}, nil
+}
+
+// RegisterKey adds publicKey as a device on the account if it isn't already
+func (m *MullvadProvider) RegisterKey(ctx context.Context, publicKey string) (string, error) {
+	var devices []mullvadDevice
+	if err := m.do(ctx, http.MethodGet, "/accounts/v1/devices", true, nil, &devices); err != nil {
+		return "", fmt.Errorf("failed to list Mullvad devices: %w", err)
+	}
+
+	for _, device := range devices {
+		if device.PublicKey == publicKey {
+			return device.addresses(), nil
+		}
+	}
+
+	slog.Info("Registering WireGuard key with Mullvad", "public_key", publicKey)
+	var device mullvadDevice
+	body := map[string]any{"pubkey": publicKey, "hijack_dns": false}
+	if err := m.do(ctx, http.MethodPost, "/accounts/v1/devices", true, body, &device); err != nil {
+		return "", fmt.Errorf("failed to register Mullvad device: %w", err)
+	}
+	return device.addresses(), nil
+}
+
+// addresses returns the device's interface addresses in comma-separated form
+func (d mullvadDevice) addresses() string {
+	var res []string
+	for _, addr := range []string{d.IPv4Address, d.IPv6Address} {
+		if addr != "" {
+			res = append(res, addr)
+		}
+	}
+	return strings.Join(res, ",")
+}
+
+// accessToken exchanges the account number for an API access token
+func (m *MullvadProvider) accessToken(ctx context.Context) (string, error) {
+	m.tokenMutex.Lock()
+	defer m.tokenMutex.Unlock()
+
+	if m.token != "" {
+		return m.token, nil
+	}
+
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	body := map[string]any{"account_number": m.account}
+	if err := m.do(ctx, http.MethodPost, "/auth/v1/token", false, body, &res); err != nil {
+		return "", fmt.Errorf("failed to authenticate with Mullvad: %w", err)
+	}
+
+	m.token = res.AccessToken
+	return m.token, nil
+}
+
+// do performs an API request, encoding body (if non-nil) and decoding the
+// response into res (if non-nil)
+func (m *MullvadProvider) do(ctx context.Context, method, path string, authenticated bool, body, res any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, m.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if authenticated {
+		token, err := m.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if res != nil {
+		return json.NewDecoder(resp.Body).Decode(res)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testMullvadServer(t *testing.T, devices *[]mullvadDevice) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /auth/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			AccountNumber string `json:"account_number"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AccountNumber != "1234" {
+			http.Error(w, "invalid account", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+	})
+	mux.HandleFunc("GET /www/relays/wireguard/", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]mullvadRelay{
+			{Hostname: "se-got-wg-001", CountryCode: "se", Active: true, IPv4AddrIn: "192.0.2.1", PublicKey: "se-key"},
+			{Hostname: "gb-lon-wg-001", CountryCode: "gb", Active: false, IPv4AddrIn: "192.0.2.2", PublicKey: "gb-key-1"},
+			{Hostname: "gb-lon-wg-002", CountryCode: "gb", Active: true, IPv4AddrIn: "192.0.2.3", PublicKey: "gb-key-2"},
+		})
+	})
+	mux.HandleFunc("/accounts/v1/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost {
+			var req struct {
+				PublicKey string `json:"pubkey"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			device := mullvadDevice{PublicKey: req.PublicKey, IPv4Address: "10.64.0.2/32", IPv6Address: "fc00:bbbb::2/128"}
+			*devices = append(*devices, device)
+			_ = json.NewEncoder(w).Encode(device)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(*devices)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMullvadProvider_SelectServer(t *testing.T) {
+	server := testMullvadServer(t, &[]mullvadDevice{})
+
+	tests := []struct {
+		name    string
+		country string
+		want    wireGuardServer
+		wantErr bool
+	}{
+		{
+			name:    "country with an inactive relay",
+			country: "GB",
+			want:    wireGuardServer{PublicKey: "gb-key-2", Endpoint: "192.0.2.3:51820"},
+		},
+		{
+			name:    "single relay",
+			country: "se",
+			want:    wireGuardServer{PublicKey: "se-key", Endpoint: "192.0.2.1:51820"},
+		},
+		{
+			name:    "no relays",
+			country: "us",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &MullvadProvider{client: server.Client(), baseURL: server.URL, account: "1234", country: tt.country}
+			got, err := p.SelectServer(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SelectServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SelectServer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMullvadProvider_RegisterKey(t *testing.T) {
+	devices := []mullvadDevice{{PublicKey: "existing", IPv4Address: "10.64.0.1/32"}}
+	server := testMullvadServer(t, &devices)
+	p := &MullvadProvider{client: server.Client(), baseURL: server.URL, account: "1234"}
+
+	got, err := p.RegisterKey(context.Background(), "existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.64.0.1/32" {
+		t.Errorf("RegisterKey(existing) = %q, want 10.64.0.1/32", got)
+	}
+
+	got, err = p.RegisterKey(context.Background(), "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.64.0.2/32,fc00:bbbb::2/128" {
+		t.Errorf("RegisterKey(new) = %q, want 10.64.0.2/32,fc00:bbbb::2/128", got)
+	}
+	if len(devices) != 2 {
+		t.Errorf("expected the new key to be registered, devices = %v", devices)
+	}
+
+	bad := &MullvadProvider{client: server.Client(), baseURL: server.URL, account: "0000"}
+	if _, err := bad.RegisterKey(context.Background(), "new"); err == nil {
+		t.Error("expected an error for an invalid account")
+	}
+}
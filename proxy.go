@@ -2,49 +2,305 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	shutdownGracePeriod = flag.Duration("shutdown-grace-period", 0, "How long to wait for active connections to finish when shutting down")
+	idleTimeout         = flag.Duration("idle-timeout", 5*time.Minute, "How long a connection can go without traffic in either direction before it is closed (0 to disable)")
+	logConnections      = flag.Bool("log-connections", false, "Log a summary of every proxied connection when it closes (otherwise only logged at debug level)")
+	copyBufferSize      = flag.Int("copy-buffer-size", 32*1024, "Size in bytes of the buffers used to copy data in each direction of a connection")
 )
 
-// Proxy handles proxying connections to WireGuard
+// copyBuffers holds buffers for copying connection data, so they don't have to
+// be allocated for every connection
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, *copyBufferSize)
+		return &buf
+	},
+}
+
+// Proxy handles proxying connections to the upstream
 type Proxy struct {
-	wgClient *WireGuardClient
-	ctx      context.Context
+	dialer       Dialer
+	ctx          context.Context
+	dialTimeouts prefixDurations
+	maxLifetimes prefixDurations
+	excluded     prefixSet
+	allowed      sourceList
+	policies     sourcePolicies
+
+	// uploadLimit and downloadLimit are shared by all connections, while
+	// each connection gets its own limiters allowing perConnLimit
+	uploadLimit   *rate.Limiter
+	downloadLimit *rate.Limiter
+	perConnLimit  int64
+	// limitCtx is cancelled once Drain's grace period is over, so waits for
+	// the limiters can't hold up shutdown
+	limitCtx    context.Context
+	cancelLimit context.CancelFunc
+
+	limiter       *connectionLimiter
+	proxyProtocol destinations
+
+	identityMutex sync.RWMutex
+	identities    IdentityResolver
+
+	active      sync.WaitGroup
+	count       atomic.Int64
+	udpSessions udpSessions
+	draining    atomic.Bool
+	paused      atomic.Bool
 }
 
 // NewProxy creates a new proxy
-func NewProxy(wgClient *WireGuardClient, ctx context.Context) *Proxy {
+func NewProxy(dialer Dialer, ctx context.Context) (*Proxy, error) {
+	dialTimeouts, err := parsePrefixDurations(*dialTimeoutOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dial timeout overrides: %w", err)
+	}
+
+	maxLifetimes, err := parsePrefixDurations(*maxLifetimeOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max lifetime overrides: %w", err)
+	}
+
+	excluded, err := parsePrefixSet(excludeIPs.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid excluded IPs: %w", err)
+	}
+
+	allowed, err := parseSourceList(allowSources.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed sources: %w", err)
+	}
+
+	policies, err := parseSourcePolicies(sourcePolicyRules.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid source policies: %w", err)
+	}
+
+	globalLimit, err := parseBandwidth(*rateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %w", err)
+	}
+
+	perConnLimit, err := parseBandwidth(*rateLimitPerConn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid per-connection rate limit: %w", err)
+	}
+
+	proxyProtocol, err := parseDestinations(proxyProtocolDestinations.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol destinations: %w", err)
+	}
+
+	limitCtx, cancelLimit := context.WithCancel(context.Background())
+
 	return &Proxy{
-		wgClient: wgClient,
-		ctx:      ctx,
+		dialer:        dialer,
+		ctx:           ctx,
+		dialTimeouts:  dialTimeouts,
+		maxLifetimes:  maxLifetimes,
+		excluded:      excluded,
+		allowed:       allowed,
+		policies:      policies,
+		uploadLimit:   newBandwidthLimiter(globalLimit),
+		downloadLimit: newBandwidthLimiter(globalLimit),
+		perConnLimit:  perConnLimit,
+		limitCtx:      limitCtx,
+		cancelLimit:   cancelLimit,
+		limiter:       newConnectionLimiter(),
+		proxyProtocol: proxyProtocol,
+	}, nil
+}
+
+// HandleFlow is called for each new TCP flow from the tailnet. The upstream
+// connection is dialled before the handshake with the client is completed, so
+// that if it fails the client is sent a RST instead of seeing a connection
+// that is accepted and then immediately closed.
+func (p *Proxy) HandleFlow(src, dst netip.AddrPort) (func(net.Conn), bool) {
+	srcAddr := src.String()
+	logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
+
+	// The connection is counted before checking whether we're draining, so
+	// that Drain can't miss one that is being dialled
+	p.active.Add(1)
+	p.count.Add(1)
+	accepted := false
+	defer func() {
+		if !accepted {
+			p.count.Add(-1)
+			p.active.Done()
+		}
+	}()
+
+	if p.draining.Load() {
+		slog.Debug("Rejecting connection while draining", "destination", logDest, "source", srcAddr)
+		return nil, true
+	}
+
+	if p.paused.Load() {
+		slog.Debug("Rejecting connection while paused", "destination", logDest, "source", srcAddr)
+		return nil, true
+	}
+
+	if p.excluded.contains(dst.Addr()) {
+		slog.Debug("Rejecting connection to excluded destination", "destination", logDest, "source", srcAddr)
+		return nil, true
+	}
+
+	if (len(p.allowed) > 0 || len(p.policies) > 0) && !p.sourceAllowed(src, dst) {
+		return nil, true
+	}
+
+	if !p.limiter.tryAcquire(src.Addr()) {
+		if !p.limiter.queues() {
+			slog.Info("Rejecting connection over the connection limit", "destination", logDest, "source", srcAddr)
+			return nil, true
+		}
+
+		// Waiting here would stop netstack accepting other new connections,
+		// so the handshake is completed and the connection queues afterwards
+		accepted = true
+		return p.queuedFlow(src, dst), true
+	}
+
+	serverConn, dialLatency, err := p.dialUpstream(src, dst)
+	if err != nil {
+		p.limiter.release(src.Addr())
+		return nil, true
 	}
+
+	accepted = true
+
+	// If the handshake with the client fails, netstack never calls the handler
+	// and nothing else would close the upstream connection.
+	abandoned := time.AfterFunc(10*time.Second, func() {
+		slog.Debug("Client never completed handshake", "destination", logDest, "source", srcAddr)
+		_ = serverConn.Close()
+		p.connectionFinished(src)
+	})
+
+	return func(clientConn net.Conn) {
+		if !abandoned.Stop() {
+			_ = clientConn.Close()
+			return
+		}
+		p.handleConnection(clientConn, serverConn, src, dst, dialLatency)
+	}, true
 }
 
-func (p *Proxy) HandleConnection(clientConn net.Conn, src, dst netip.AddrPort) {
-	defer clientConn.Close()
+// queuedFlow returns a handler for a connection that arrived while the
+// connection limit was reached, which waits for a slot once the handshake
+// with the client is complete. The connection must already be counted.
+func (p *Proxy) queuedFlow(src, dst netip.AddrPort) func(net.Conn) {
+	srcAddr := src.String()
+	logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
+
+	abandoned := time.AfterFunc(10*time.Second, func() {
+		slog.Debug("Client never completed handshake", "destination", logDest, "source", srcAddr)
+		p.count.Add(-1)
+		p.active.Done()
+	})
+
+	return func(clientConn net.Conn) {
+		if !abandoned.Stop() {
+			_ = clientConn.Close()
+			return
+		}
+
+		if !p.limiter.acquire(p.ctx, src.Addr()) {
+			slog.Info("Closing queued connection over the connection limit", "destination", logDest, "source", srcAddr)
+			_ = clientConn.Close()
+			p.count.Add(-1)
+			p.active.Done()
+			return
+		}
 
-	destAddr := dst.String()
+		serverConn, dialLatency, err := p.dialUpstream(src, dst)
+		if err != nil {
+			_ = clientConn.Close()
+			p.connectionFinished(src)
+			return
+		}
+		p.handleConnection(clientConn, serverConn, src, dst, dialLatency)
+	}
+}
+
+// dialUpstream connects to dst via the upstream on behalf of src, sending a
+// PROXY protocol header if one is configured for dst
+func (p *Proxy) dialUpstream(src, dst netip.AddrPort) (net.Conn, time.Duration, error) {
 	srcAddr := src.String()
+	logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
 
-	slog.Debug("Connection opened", "destination", destAddr, "source", srcAddr)
+	slog.Debug("Connection opened", "destination", logDest, "source", srcAddr)
 
-	dialCtx, dialCancel := context.WithTimeout(p.ctx, 10*time.Second)
+	dialCtx, dialCancel := context.WithTimeout(p.ctx, p.dialTimeouts.lookup(dst.Addr(), *dialTimeout))
 	defer dialCancel()
 
-	serverConn, err := p.wgClient.DialContext(dialCtx, "tcp", destAddr)
+	dialStart := time.Now()
+	serverConn, err := p.dialer.DialContext(dialCtx, "tcp", dst.String())
+	dialLatency := time.Since(dialStart)
 	if err != nil {
-		slog.Error("Failed to dial through WireGuard", "destination", destAddr, "source", srcAddr, "error", err)
-		return
+		slog.Error("Failed to dial upstream", "destination", logDest, "source", srcAddr, "error", redactError(err, dst, *logPrivacy, *logPrivacySalt))
+		return nil, 0, err
+	}
+
+	slog.Debug("Connected to destination via upstream", "destination", logDest, "source", srcAddr, "dial_latency", dialLatency)
+
+	if p.proxyProtocol.contains(dst) {
+		if err := writeProxyHeader(serverConn, src, dst); err != nil {
+			slog.Error("Failed to send PROXY protocol header", "destination", logDest, "source", srcAddr, "error", redactError(err, dst, *logPrivacy, *logPrivacySalt))
+			_ = serverConn.Close()
+			return nil, 0, err
+		}
 	}
+	proxyDialDuration.WithLabelValues("tcp", strconv.Itoa(int(dst.Port()))).Observe(dialLatency.Seconds())
+
+	return serverConn, dialLatency, nil
+}
+
+// handleConnection copies data between an accepted client connection and its
+// upstream connection until either side closes
+func (p *Proxy) handleConnection(clientConn, serverConn net.Conn, src, dst netip.AddrPort, dialLatency time.Duration) {
+	srcAddr := src.String()
+	logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
+	port := strconv.Itoa(int(dst.Port()))
+	source := metricsSource(src.Addr())
+	start := time.Now()
+
+	proxyConnections.WithLabelValues("tcp", port, source).Inc()
+	sent := &countingWriter{counter: proxyBytes.WithLabelValues("sent", "tcp", port, source)}
+	received := &countingWriter{counter: proxyBytes.WithLabelValues("received", "tcp", port, source)}
+
+	defer p.connectionFinished(src)
+	defer clientConn.Close()
 	defer func() {
 		serverConn.Close()
-		slog.Debug("Connection closed", "destination", destAddr, "source", srcAddr)
-	}()
 
-	slog.Debug("Connected to destination via WireGuard", "destination", destAddr, "source", srcAddr)
+		duration := time.Since(start)
+		proxyConnectionDuration.WithLabelValues("tcp", port).Observe(duration.Seconds())
+
+		level := slog.LevelDebug
+		if *logConnections {
+			level = slog.LevelInfo
+		}
+		slog.Log(p.ctx, level, "Connection closed", "destination", logDest, "source", srcAddr, "duration", duration, "dial_latency", dialLatency, "bytes_sent", sent.total.Load(), "bytes_received", received.total.Load())
+	}()
 
 	if tcpConn, ok := serverConn.(*net.TCPConn); ok {
 		_ = tcpConn.SetKeepAlive(true)
@@ -55,11 +311,30 @@ func (p *Proxy) HandleConnection(clientConn net.Conn, src, dst netip.AddrPort) {
 		_ = setter.SetNoDelay(true)
 	}
 
+	var lifetime <-chan time.Time
+	if d := p.maxLifetimes.lookup(dst.Addr(), *maxLifetime); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if *idleTimeout > 0 {
+		idleTimer = time.NewTimer(*idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	done := make(chan struct{})
 
 	go func() {
-		if _, err := io.Copy(serverConn, clientConn); err != nil {
-			slog.Debug("Client to server copy error", "destination", destAddr, "source", srcAddr, "error", err)
+		upload := limitReader(p.limitCtx, activityReader{clientConn, &lastActive}, p.uploadLimit, newBandwidthLimiter(p.perConnLimit))
+		if _, err := copyBuffered(io.MultiWriter(serverConn, sent), upload); err != nil {
+			slog.Debug("Client to server copy error", "destination", logDest, "source", srcAddr, "error", redactError(err, dst, *logPrivacy, *logPrivacySalt))
 		}
 		if closer, ok := serverConn.(interface{ CloseWrite() error }); ok {
 			_ = closer.CloseWrite()
@@ -68,19 +343,163 @@ func (p *Proxy) HandleConnection(clientConn net.Conn, src, dst netip.AddrPort) {
 
 	go func() {
 		defer close(done)
-		if _, err := io.Copy(clientConn, serverConn); err != nil {
-			slog.Debug("Server to client copy error", "destination", destAddr, "source", srcAddr, "error", err)
+		download := limitReader(p.limitCtx, activityReader{serverConn, &lastActive}, p.downloadLimit, newBandwidthLimiter(p.perConnLimit))
+		if _, err := copyBuffered(io.MultiWriter(clientConn, received), download); err != nil {
+			slog.Debug("Server to client copy error", "destination", logDest, "source", srcAddr, "error", redactError(err, dst, *logPrivacy, *logPrivacySalt))
 		}
 		if closer, ok := clientConn.(interface{ CloseWrite() error }); ok {
 			_ = closer.CloseWrite()
 		}
 	}()
 
-	select {
-	case <-done:
-	case <-time.After(5 * time.Minute):
-		slog.Debug("Connection idle timeout", "destination", destAddr, "source", srcAddr)
+	for {
+		select {
+		case <-done:
+			return
+		case <-idle:
+			if remaining := *idleTimeout - time.Since(time.Unix(0, lastActive.Load())); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			slog.Debug("Connection idle timeout", "destination", logDest, "source", srcAddr)
+		case <-lifetime:
+			slog.Debug("Connection reached maximum lifetime", "destination", logDest, "source", srcAddr)
+		}
+
 		_ = clientConn.Close()
 		_ = serverConn.Close()
+		return
+	}
+}
+
+// copyBuffered copies from src to dst until EOF or an error, using a buffer
+// from the pool
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// countingWriter counts the bytes written to it, which are discarded
+type countingWriter struct {
+	counter prometheus.Counter
+	total   atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.counter.Add(float64(len(p)))
+	w.total.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// activityReader records the time of every read that returns data
+type activityReader struct {
+	io.Reader
+	lastActive *atomic.Int64
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// SetIdentityResolver sets how the tailnet identity of a connection's source
+// is looked up. Until it is set, connections are refused if --allow-sources
+// or --source-policies are in use.
+func (p *Proxy) SetIdentityResolver(identities IdentityResolver) {
+	p.identityMutex.Lock()
+	defer p.identityMutex.Unlock()
+	p.identities = identities
+}
+
+// sourceAllowed returns whether the tailnet identity behind src is allowed to
+// connect to dst via the proxy
+func (p *Proxy) sourceAllowed(src, dst netip.AddrPort) bool {
+	p.identityMutex.RLock()
+	identities := p.identities
+	p.identityMutex.RUnlock()
+
+	if identities == nil {
+		slog.Debug("Rejecting connection before identities can be checked", "source", src.String())
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+	defer cancel()
+
+	who, err := identities.WhoIs(ctx, src.Addr().String())
+	if err != nil {
+		slog.Warn("Rejecting connection from unknown source", "source", src.String(), "error", err)
+		return false
+	}
+
+	if len(p.allowed) > 0 && !p.allowed.matches(who) {
+		slog.Info("Rejecting connection from source that isn't allowed", "source", src.String(), "identity", describeIdentity(who))
+		return false
+	}
+
+	if !p.policies.permits(who, dst) {
+		logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
+		slog.Info("Rejecting connection to destination not permitted by policy", "destination", logDest, "source", src.String(), "identity", describeIdentity(who))
+		return false
+	}
+
+	return true
+}
+
+// connectionFinished records that a connection from src counted by
+// HandleFlow is done
+func (p *Proxy) connectionFinished(src netip.AddrPort) {
+	p.limiter.release(src.Addr())
+	p.count.Add(-1)
+	p.active.Done()
+}
+
+// ActiveConnections returns the number of connections currently being proxied
+func (p *Proxy) ActiveConnections() int64 {
+	return p.count.Load()
+}
+
+// SetPaused sets whether new connections are refused. Existing connections
+// are unaffected.
+func (p *Proxy) SetPaused(paused bool) {
+	p.paused.Store(paused)
+}
+
+// Paused returns whether new connections are being refused
+func (p *Proxy) Paused() bool {
+	return p.paused.Load()
+}
+
+// Drain stops accepting new connections, and waits up to timeout for active
+// connections to finish. UDP flows have no way to finish cleanly, so are
+// closed straight away.
+func (p *Proxy) Drain(timeout time.Duration) {
+	p.draining.Store(true)
+	p.udpSessions.closeAll()
+	if p.cancelLimit != nil {
+		defer p.cancelLimit()
+	}
+
+	if timeout <= 0 || p.ActiveConnections() == 0 {
+		return
+	}
+
+	slog.Info("Waiting for active connections to finish", "active", p.ActiveConnections(), "timeout", timeout)
+
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("All connections finished")
+	case <-time.After(timeout):
+		slog.Warn("Timed out waiting for connections to finish", "active", p.ActiveConnections())
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandleConnectionIdleTimeout(t *testing.T) {
+	previous := *idleTimeout
+	*idleTimeout = 200 * time.Millisecond
+	defer func() { *idleTimeout = previous }()
+
+	proxy := &Proxy{}
+	client, clientProxy := net.Pipe()
+	server, serverProxy := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Echo everything the server receives
+	go func() { _, _ = io.Copy(server, server) }()
+
+	proxy.active.Add(1)
+	proxy.count.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.handleConnection(clientProxy, serverProxy, netip.MustParseAddrPort("100.64.0.2:40000"), netip.MustParseAddrPort("192.0.2.1:443"), time.Millisecond)
+	}()
+
+	// Keep the connection active for longer than the timeout
+	for range 4 {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("connection closed while still active")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection wasn't closed after being idle")
+	}
+
+	if proxy.ActiveConnections() != 0 {
+		t.Errorf("ActiveConnections() = %d, want 0", proxy.ActiveConnections())
+	}
+
+	for _, direction := range []string{"sent", "received"} {
+		if got := testutil.ToFloat64(proxyBytes.WithLabelValues(direction, "tcp", "443", "")); got != 16 {
+			t.Errorf("%s bytes = %v, want 16", direction, got)
+		}
+	}
+	if got := testutil.ToFloat64(proxyConnections.WithLabelValues("tcp", "443", "")); got != 1 {
+		t.Errorf("connections = %v, want 1", got)
+	}
+}
+
+func TestHandleFlowWhileDraining(t *testing.T) {
+	proxy := &Proxy{}
+	proxy.Drain(0)
+
+	src := netip.MustParseAddrPort("100.64.0.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	if handler, _ := proxy.HandleFlow(src, dst); handler != nil {
+		t.Error("HandleFlow() accepted a connection while draining")
+	}
+	if n := proxy.ActiveConnections(); n != 0 {
+		t.Errorf("ActiveConnections() = %d after a rejected connection, want 0", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		proxy.Drain(time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Drain() waited for a rejected connection")
+	}
+}
+
+func TestHandleFlowOverConnectionLimit(t *testing.T) {
+	other := netip.MustParseAddr("100.64.0.3")
+	src := netip.MustParseAddrPort("100.64.0.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+
+	t.Run("reject", func(t *testing.T) {
+		dialer := &recordingDialer{}
+		proxy := &Proxy{dialer: dialer, ctx: context.Background(), limiter: &connectionLimiter{max: 1, bySource: make(map[netip.Addr]int), released: make(chan struct{})}}
+		proxy.limiter.tryAcquire(other)
+
+		if handler, _ := proxy.HandleFlow(src, dst); handler != nil {
+			t.Error("HandleFlow() accepted a connection over the limit")
+		}
+		if n := proxy.ActiveConnections(); n != 0 {
+			t.Errorf("ActiveConnections() = %d, want 0", n)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		dialer := &recordingDialer{}
+		proxy := &Proxy{dialer: dialer, ctx: context.Background(), limiter: &connectionLimiter{max: 1, queue: true, queueTimeout: time.Second, bySource: make(map[netip.Addr]int), released: make(chan struct{})}}
+		proxy.limiter.tryAcquire(other)
+
+		// The handshake is completed straight away, and the connection waits
+		// for a slot afterwards
+		handler, _ := proxy.HandleFlow(src, dst)
+		if handler == nil {
+			t.Fatal("HandleFlow() rejected a connection that should be queued")
+		}
+		if n := dialer.dials.Load(); n != 0 {
+			t.Errorf("queued connection dialled the upstream %d times before getting a slot", n)
+		}
+
+		client, server := net.Pipe()
+		defer client.Close()
+		time.AfterFunc(50*time.Millisecond, func() { proxy.limiter.release(other) })
+		handler(server)
+
+		if n := dialer.dials.Load(); n != 1 {
+			t.Errorf("queued connection dialled the upstream %d times, want 1", n)
+		}
+		if n := proxy.ActiveConnections(); n != 0 {
+			t.Errorf("ActiveConnections() = %d after the connection finished, want 0", n)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+var (
+	proxyProtocolDestinations = listFlag("proxy-protocol", "", "Destinations to send a PROXY protocol v2 header with the client's tailnet address to (comma-separated prefix[:ports], may be repeated; e.g. 192.168.1.10:443)")
+)
+
+// destinations is a list of address and port ranges
+type destinations []destination
+
+// parseDestinations parses a comma-separated list of CIDR prefixes or IP
+// addresses, each optionally followed by a port or port range
+func parseDestinations(s string) (destinations, error) {
+	var res destinations
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		dest, err := parseDestination(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %s: %w", entry, err)
+		}
+		res = append(res, dest)
+	}
+	return res, nil
+}
+
+// contains returns whether dst is within any of the ranges
+func (d destinations) contains(dst netip.AddrPort) bool {
+	for _, dest := range d {
+		if dest.contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProxyHeader writes a PROXY protocol v2 header describing a TCP
+// connection from src to dst
+func writeProxyHeader(w io.Writer, src, dst netip.AddrPort) error {
+	protocol := proxyproto.TCPv4
+	if !src.Addr().Unmap().Is4() || !dst.Addr().Unmap().Is4() {
+		// The header can't mix address families, so IPv4 addresses are sent
+		// mapped into IPv6 if either side is IPv6
+		protocol = proxyproto.TCPv6
+	}
+
+	header := &proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: protocol,
+		SourceAddr:        net.TCPAddrFromAddrPort(netip.AddrPortFrom(src.Addr().Unmap(), src.Port())),
+		DestinationAddr:   net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())),
+	}
+	_, err := header.WriteTo(w)
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestParseDestinations(t *testing.T) {
+	dests, err := parseDestinations("192.168.1.10:443, 10.0.0.0/8:8000-8999, 2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseDestinations() error = %v", err)
+	}
+
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"192.168.1.10:443", true},
+		{"192.168.1.10:80", false},
+		{"10.1.2.3:8080", true},
+		{"10.1.2.3:9000", false},
+		{"[2001:db8::1]:22", true},
+		{"203.0.113.1:443", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dst, func(t *testing.T) {
+			if got := dests.contains(netip.MustParseAddrPort(tt.dst)); got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.dst, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseDestinations("192.168.1.10:http"); err == nil {
+		t.Error("parseDestinations() with invalid port succeeded, want error")
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          string
+		dst          string
+		wantProtocol proxyproto.AddressFamilyAndProtocol
+		wantSrc      string
+		wantDst      string
+	}{
+		{"ipv4", "100.64.0.2:40000", "192.168.1.10:443", proxyproto.TCPv4, "100.64.0.2:40000", "192.168.1.10:443"},
+		{"ipv6", "[fd7a:115c:a1e0::2]:40000", "[2001:db8::1]:443", proxyproto.TCPv6, "[fd7a:115c:a1e0::2]:40000", "[2001:db8::1]:443"},
+		{"mixed", "100.64.0.2:40000", "[2001:db8::1]:443", proxyproto.TCPv6, "100.64.0.2:40000", "[2001:db8::1]:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, netip.MustParseAddrPort(tt.src), netip.MustParseAddrPort(tt.dst)); err != nil {
+				t.Fatalf("writeProxyHeader() error = %v", err)
+			}
+
+			header, err := proxyproto.Read(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if header.Version != 2 || header.TransportProtocol != tt.wantProtocol {
+				t.Errorf("header version %d protocol %v, want 2 and %v", header.Version, header.TransportProtocol, tt.wantProtocol)
+			}
+
+			src := header.SourceAddr.(*net.TCPAddr).AddrPort()
+			dst := header.DestinationAddr.(*net.TCPAddr).AddrPort()
+			if got := netip.AddrPortFrom(src.Addr().Unmap(), src.Port()).String(); got != tt.wantSrc {
+				t.Errorf("source = %s, want %s", got, tt.wantSrc)
+			}
+			if got := netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()).String(); got != tt.wantDst {
+				t.Errorf("destination = %s, want %s", got, tt.wantDst)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	rateLimit        = flag.String("rate-limit", "", "Maximum bandwidth of all proxied connections combined in each direction, in bytes per second with an optional k, M or G suffix (e.g. 10M; unlimited if empty)")
+	rateLimitPerConn = flag.String("rate-limit-per-conn", "", "Maximum bandwidth of each proxied connection in each direction, in bytes per second with an optional k, M or G suffix (e.g. 1M; unlimited if empty)")
+)
+
+// parseBandwidth parses a bandwidth in bytes per second, with an optional
+// decimal k, M or G suffix. An empty string or zero means unlimited.
+func parseBandwidth(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	value := s
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		multiplier = 1_000
+	case 'm', 'M':
+		multiplier = 1_000_000
+	case 'g', 'G':
+		multiplier = 1_000_000_000
+	}
+	if multiplier > 1 {
+		value = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// newBandwidthLimiter returns a token bucket allowing bytesPerSecond, with a
+// burst of up to one second's worth, or nil if bytesPerSecond is zero
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, math.MaxInt32)))
+}
+
+// rateLimitedReader waits for each of its limiters to allow the data it reads
+// before returning it
+type rateLimitedReader struct {
+	io.Reader
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// limitReader wraps r so that reads are limited by each non-nil limiter.
+// Waits for the limiters end with an error once ctx is cancelled.
+func limitReader(ctx context.Context, r io.Reader, limiters ...*rate.Limiter) io.Reader {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return r
+	}
+	return &rateLimitedReader{Reader: r, ctx: ctx, limiters: active}
+}
+
+// activeLimiters returns the non-nil limiters
+func activeLimiters(limiters []*rate.Limiter) []*rate.Limiter {
+	var active []*rate.Limiter
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+	return active
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Never read more than a limiter could allow at once
+	for _, limiter := range r.limiters {
+		if len(p) > limiter.Burst() {
+			p = p[:limiter.Burst()]
+		}
+	}
+
+	n, err := r.Reader.Read(p)
+	for _, limiter := range r.limiters {
+		// Connections should be able to finish while draining, so this isn't
+		// tied to the proxy's context. A shared limiter can make waits much
+		// longer than a second when it's busy, though, so ctx ends them once
+		// the grace period is over.
+		if waitErr := limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// rateLimitedPacketConn waits for each of its limiters to allow the packets
+// it reads before returning them. Packets can't be split, so one bigger than
+// a limiter's burst only waits for a full burst.
+type rateLimitedPacketConn struct {
+	net.Conn
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// limitPacketConn wraps a packet-oriented conn so that reads are limited by
+// each non-nil limiter. Waits for the limiters end with an error once ctx is
+// cancelled.
+func limitPacketConn(ctx context.Context, c net.Conn, limiters ...*rate.Limiter) net.Conn {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return c
+	}
+	return &rateLimitedPacketConn{Conn: c, ctx: ctx, limiters: active}
+}
+
+func (c *rateLimitedPacketConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, limiter := range c.limiters {
+		// As with rateLimitedReader, ctx is only cancelled once the grace
+		// period for draining is over
+		if waitErr := limiter.WaitN(c.ctx, min(n, limiter.Burst())); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"1500", 1500, false},
+		{"10k", 10_000, false},
+		{"10M", 10_000_000, false},
+		{" 2G ", 2_000_000_000, false},
+		{"M", 0, true},
+		{"-1M", 0, true},
+		{"1.5M", 0, true},
+		{"10Mbit", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseBandwidth(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBandwidth(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseBandwidth(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	if r := limitReader(context.Background(), bytes.NewReader(nil), nil, nil); r == nil {
+		t.Fatal("limitReader() = nil")
+	} else if _, ok := r.(*rateLimitedReader); ok {
+		t.Error("limitReader() without limiters should return the reader unchanged")
+	}
+
+	// The first 10kB is allowed straight away as a burst, then the rest should
+	// take half a second
+	data := make([]byte, 15_000)
+	r := limitReader(context.Background(), bytes.NewReader(data), newBandwidthLimiter(100_000), newBandwidthLimiter(10_000))
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("Copy() = %d bytes, want %d", n, len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Copy() took %s, want around 500ms", elapsed)
+	}
+}
+
+func TestLimitReaderCancelled(t *testing.T) {
+	// Reading everything would take several seconds, but the wait ends as
+	// soon as the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	r := limitReader(ctx, bytes.NewReader(make([]byte, 50_000)), newBandwidthLimiter(10_000))
+
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("Copy() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Copy() took %s after being cancelled", elapsed)
+	}
+}
+
+func TestLimitPacketConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if c := limitPacketConn(context.Background(), server, nil); c != server {
+		t.Error("limitPacketConn() without limiters should return the conn unchanged")
+	}
+
+	// Packets bigger than the burst are returned whole, and the 10kB burst
+	// covers the first one, so the rest should take around a second
+	packets := [][]byte{make([]byte, 10_000), make([]byte, 20_000), make([]byte, 1)}
+	go func() {
+		for _, packet := range packets {
+			if _, err := client.Write(packet); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := limitPacketConn(context.Background(), server, newBandwidthLimiter(10_000))
+	buf := make([]byte, maxUDPPacketSize)
+	start := time.Now()
+	for i, packet := range packets {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if n != len(packet) {
+			t.Errorf("packet %d: Read() = %d bytes, want %d", i, n, len(packet))
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Read() took %s, want around 1s", elapsed)
+	}
+}
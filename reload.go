@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+// explicitFlags returns the names of all flags that have been set on fs
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	res := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		res[f.Name] = true
+	})
+	return res
+}
+
+// reloadFlags re-reads the config file into a copy of fs, without modifying
+// any of the running configuration. Flags named in explicit were given on the
+// command line or in the environment, and keep their current values.
+func reloadFlags(fs *flag.FlagSet, explicit map[string]bool, path string) (*flag.FlagSet, error) {
+	res := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	fs.VisitAll(func(f *flag.Flag) {
+		res.String(f.Name, f.DefValue, f.Usage)
+		if explicit[f.Name] {
+			_ = res.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if err := applyConfigFile(res, path); err != nil {
+		return nil, err
+	}
+	if err := readSecretFiles(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReloadConfig re-reads the config file and applies any changes to the
+// WireGuard peer to the running tunnel. Other settings require a restart.
+func ReloadConfig(wg *WireGuardClient, explicit map[string]bool) error {
+	if *configFile == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+
+	fs, err := reloadFlags(flag.CommandLine, explicit, *configFile)
+	if err != nil {
+		return err
+	}
+
+	if wg == nil {
+		slog.Info("Reloaded config file, but the current upstream has no reloadable settings")
+		return nil
+	}
+
+	if fs.Lookup("wg-provider").Value.String() != "" {
+		slog.Info("Reloaded config file, WireGuard peer is managed by the VPN provider")
+		return nil
+	}
+
+	peer := PeerSettings{
+		PublicKey:    fs.Lookup("wg-public-key").Value.String(),
+		PresharedKey: fs.Lookup("wg-preshared-key").Value.String(),
+		Endpoint:     fs.Lookup("wg-endpoint").Value.String(),
+		AllowedIPs:   fs.Lookup("wg-allowed-ips").Value.String(),
+	}
+	if peer.PublicKey == "" || peer.Endpoint == "" {
+		return fmt.Errorf("--wg-public-key and --wg-endpoint are required")
+	}
+
+	changed, err := wg.ReloadPeer(peer)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		slog.Info("Reloaded config file, WireGuard peer is unchanged")
+		return nil
+	}
+	slog.Info("Reloaded config file and updated WireGuard peer", "endpoint", peer.Endpoint)
+	return nil
+}
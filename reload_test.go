@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReloadFlags(t *testing.T) {
+	fs := testConfigFlagSet()
+	if err := fs.Parse([]string{"-tailscale-hostname=cli"}); err != nil {
+		t.Fatal(err)
+	}
+	explicit := explicitFlags(fs)
+
+	path := writeConfig(t, "config.yaml", "wg:\n  endpoint: old:51820\n  dns: 1.1.1.1\ntailscale-hostname: file\n")
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("wg:\n  endpoint: new:51820\ntailscale-hostname: file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := reloadFlags(fs, explicit, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"wg-endpoint":        "new:51820",
+		"wg-dns":             "9.9.9.9",
+		"tailscale-hostname": "cli",
+	}
+	for name, value := range want {
+		if got := reloaded.Lookup(name).Value.String(); got != value {
+			t.Errorf("reloaded %s = %q, want %q", name, got, value)
+		}
+	}
+
+	if got := fs.Lookup("wg-endpoint").Value.String(); got != "old:51820" {
+		t.Errorf("original wg-endpoint = %q, want it to be unchanged", got)
+	}
+}
+
+func TestReloadFlags_InvalidFile(t *testing.T) {
+	fs := testConfigFlagSet()
+	path := writeConfig(t, "config.yaml", "unknown: value\n")
+
+	if _, err := reloadFlags(fs, explicitFlags(fs), path); err == nil {
+		t.Error("expected an error for an unknown setting")
+	}
+}
+
+func TestReloadConfigAfterRotation(t *testing.T) {
+	privateKey, configuredKey, err := GenerateWireGuardKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rotatedKey, err := GenerateWireGuardKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &WireGuardConfig{
+		PrivateKey:    privateKey,
+		PeerPublicKey: configuredKey,
+		Endpoint:      "127.0.0.1:51820",
+		AllowedIPs:    "0.0.0.0/0,::/0",
+		Address:       "10.0.0.2/32",
+		DNSServers:    "9.9.9.9",
+		MTU:           1420,
+	}
+	dev, tnet, err := cfg.createNetTUN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	wg := &WireGuardClient{dev: dev, tun: tnet, config: cfg, configuredPeer: cfg.peerSettings()}
+
+	path := writeConfig(t, "config.yaml", "wg:\n  public-key: "+configuredKey+"\n  endpoint: 127.0.0.1:51820\n")
+	previous := *configFile
+	*configFile = path
+	defer func() { *configFile = previous }()
+
+	rotated := cfg.peerSettings()
+	rotated.PublicKey = rotatedKey
+	rotated.Endpoint = "127.0.0.1:51821"
+	if err := wg.UpdatePeer(rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReloadConfig(wg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := wg.PeerSettings(); got != rotated {
+		t.Errorf("PeerSettings() after reloading an unchanged file = %+v, want the rotated peer %+v", got, rotated)
+	}
+
+	if err := os.WriteFile(path, []byte("wg:\n  public-key: "+configuredKey+"\n  endpoint: 127.0.0.1:51822\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfig(wg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := wg.PeerSettings(); got.PublicKey != configuredKey || got.Endpoint != "127.0.0.1:51822" {
+		t.Errorf("PeerSettings() after changing the file = %+v, want the new configured peer", got)
+	}
+}
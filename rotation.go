@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+var (
+	wgRotationServers = flag.String("wg-rotation-servers", "", "WireGuard servers to rotate between (comma-separated host:port, or public-key[:preshared-key]@host:port for servers with their own key)")
+	wgRotationPeriod  = flag.Duration("wg-rotation-period", 0, "How often to rotate to the next WireGuard server (0 to disable)")
+)
+
+// wireGuardServer is a WireGuard peer that the client can rotate to
+type wireGuardServer struct {
+	PublicKey    string
+	PresharedKey string
+	Endpoint     string
+}
+
+// parseRotationServers parses a comma-separated list of servers. Servers
+// without an explicit public key use defaultKey and defaultPSK. Servers with
+// their own key only use a preshared key if one is given with it, unless the
+// key is defaultKey.
+func parseRotationServers(servers, defaultKey, defaultPSK string) ([]wireGuardServer, error) {
+	var res []wireGuardServer
+	for _, entry := range strings.Split(servers, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		server := wireGuardServer{PublicKey: defaultKey, PresharedKey: defaultPSK, Endpoint: entry}
+		if keys, endpoint, ok := strings.Cut(entry, "@"); ok {
+			server.Endpoint = endpoint
+			server.PublicKey, server.PresharedKey, ok = strings.Cut(keys, ":")
+			if !ok && server.PublicKey == defaultKey {
+				server.PresharedKey = defaultPSK
+			}
+		}
+
+		// The entry isn't included in errors as it may contain a preshared key
+		if key, err := base64.StdEncoding.DecodeString(server.PublicKey); err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid public key for rotation server %s", server.Endpoint)
+		}
+		if server.PresharedKey != "" {
+			if key, err := base64.StdEncoding.DecodeString(server.PresharedKey); err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("invalid preshared key for rotation server %s", server.Endpoint)
+			}
+		}
+
+		res = append(res, server)
+	}
+	return res, nil
+}
+
+// rotateServers periodically switches the tunnel to the next server in the list
+func (wg *WireGuardClient) rotateServers(servers []wireGuardServer, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	next := 0
+	for {
+		select {
+		case <-wg.ctx.Done():
+			return
+		case <-ticker.C:
+			peer := wg.PeerSettings()
+			current := wireGuardServer{PublicKey: peer.PublicKey, PresharedKey: peer.PresharedKey, Endpoint: peer.Endpoint}
+
+			// Skip the server we're already on, unless it's the only option
+			if servers[next%len(servers)] == current && len(servers) > 1 {
+				next++
+			}
+			server := servers[next%len(servers)]
+			next++
+
+			if server == current {
+				continue
+			}
+
+			slog.Info("Rotating WireGuard server", "from", current.Endpoint, "to", server.Endpoint)
+			peer.PublicKey = server.PublicKey
+			peer.PresharedKey = server.PresharedKey
+			peer.Endpoint = server.Endpoint
+			if err := wg.UpdatePeer(peer); err != nil {
+				slog.Error("Failed to rotate WireGuard server", "endpoint", server.Endpoint, "error", err)
+			}
+		}
+	}
+}
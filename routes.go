@@ -0,0 +1,711 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var (
+	tsSkipConflictingRoutes = flag.Bool("tailscale-skip-conflicting-routes", false, "Don't advertise extra routes that overlap routes advertised by other nodes in the tailnet")
+	tsAutoApproveRoutes     = flag.Bool("tailscale-auto-approve-routes", false, "Approve the node's own advertised routes using the Tailscale API (requires --tailscale-api-key or --tailscale-oauth-client-secret)")
+	tsRoutesFile            = flag.String("tailscale-routes-file", "", "File to save routes changed through the control interface to, which then replace the configured routes when starting (disabled if blank)")
+	tsRoutesWebhook         = flag.String("tailscale-routes-webhook", "", "URL to POST a JSON notification to whenever the advertised routes change (disabled if empty)")
+	tsRouteHistory          = flag.Int("tailscale-route-history", 50, "Number of recent changes to the advertised routes to keep for `tsv status --verbose` and the control interface (0 to keep none)")
+	tsRouteDebounce         = flag.Duration("tailscale-route-debounce", time.Second, "How long to collect route changes caused by health or standby checks before applying them together (0 to apply each straight away)")
+)
+
+// exitNodeRoutes are the routes advertised by an exit node
+var exitNodeRoutes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// routeApproval describes which of the node's advertised routes are approved
+type routeApproval struct {
+	deviceID   string
+	advertised []netip.Prefix
+	unapproved []netip.Prefix
+}
+
+// MonitorRouteApproval periodically compares the routes the node advertises
+// with those approved in the admin console, and warns about (or approves) any
+// that are still waiting for approval
+func MonitorRouteApproval(ctx context.Context, lc *local.Client) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var previous []netip.Prefix
+	for {
+		approval, err := checkRouteApproval(ctx, lc)
+		if err != nil {
+			slog.Warn("Failed to check route approval", "error", err)
+		} else {
+			unapproved := approval.unapproved
+			tailscaleUnapprovedRoutes.Set(float64(len(unapproved)))
+			handled := true
+			if len(unapproved) > 0 && !slices.Equal(unapproved, previous) {
+				if *tsAutoApproveRoutes {
+					if err := approveRoutes(ctx, approval); err != nil {
+						slog.Error("Failed to approve routes, approve them in the Tailscale admin console instead", "error", err)
+						// Try again next time
+						handled = false
+					}
+				} else {
+					slog.Warn("Advertised routes are waiting for approval in the Tailscale admin console, and won't be used by clients until they are approved", "routes", unapproved)
+				}
+			} else if len(unapproved) == 0 && len(previous) > 0 {
+				slog.Info("All advertised routes have been approved")
+			}
+			if handled {
+				previous = unapproved
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkRouteApproval finds the advertised routes that haven't been approved
+func checkRouteApproval(ctx context.Context, lc *local.Client) (*routeApproval, error) {
+	prefs, err := lc.GetPrefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	approval := &routeApproval{advertised: prefs.AdvertiseRoutes}
+	var allowed []netip.Prefix
+	if status.Self != nil {
+		approval.deviceID = string(status.Self.ID)
+		if status.Self.AllowedIPs != nil {
+			allowed = status.Self.AllowedIPs.AsSlice()
+		}
+	}
+	approval.unapproved = unapprovedRoutes(prefs.AdvertiseRoutes, allowed)
+	return approval, nil
+}
+
+// approveRoutes approves all of the node's advertised routes using the
+// Tailscale API
+func approveRoutes(ctx context.Context, approval *routeApproval) error {
+	slog.Info("Approving advertised routes using the Tailscale API", "routes", approval.unapproved)
+
+	api, err := newConfiguredTailscaleAPI(ctx)
+	if err != nil {
+		return err
+	}
+	return api.SetDeviceRoutes(ctx, approval.deviceID, approval.advertised)
+}
+
+// unapprovedRoutes returns the advertised routes that control hasn't allowed
+// the node to route
+func unapprovedRoutes(advertised, allowed []netip.Prefix) []netip.Prefix {
+	var res []netip.Prefix
+	for _, route := range advertised {
+		if !slices.Contains(allowed, route) {
+			res = append(res, route)
+		}
+	}
+	return res
+}
+
+// routeConflict is an advertised route that overlaps another node's route
+type routeConflict struct {
+	Route     netip.Prefix
+	Peer      string
+	PeerRoute netip.Prefix
+}
+
+// MonitorRouteConflicts periodically checks whether other nodes in the
+// tailnet have started (or stopped) advertising routes that overlap the
+// node's own
+func MonitorRouteConflicts(ctx context.Context, advertiser *RouteAdvertiser) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var previous []routeConflict
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		conflicts, err := advertiser.checkConflicts(ctx, previous)
+		if err != nil {
+			slog.Warn("Failed to check for route conflicts", "error", err)
+		}
+		previous = conflicts
+	}
+}
+
+// routeConflicts returns the routes that overlap a subnet route of a peer.
+// Exit node routes are ignored, as every exit node advertises them.
+func routeConflicts(routes []netip.Prefix, status *ipnstate.Status) []routeConflict {
+	var res []routeConflict
+	for _, peer := range status.Peer {
+		if peer.PrimaryRoutes == nil {
+			continue
+		}
+		for _, peerRoute := range peer.PrimaryRoutes.All() {
+			if peerRoute.Bits() == 0 {
+				continue
+			}
+			for _, route := range routes {
+				if route.Bits() != 0 && route.Overlaps(peerRoute) {
+					res = append(res, routeConflict{Route: route, Peer: peer.HostName, PeerRoute: peerRoute})
+				}
+			}
+		}
+	}
+	slices.SortFunc(res, func(a, b routeConflict) int {
+		return cmp.Or(a.Route.Addr().Compare(b.Route.Addr()), cmp.Compare(a.Peer, b.Peer), a.PeerRoute.Addr().Compare(b.PeerRoute.Addr()))
+	})
+	return res
+}
+
+// conflictingRoutes returns the distinct routes involved in conflicts
+func conflictingRoutes(conflicts []routeConflict) []netip.Prefix {
+	var res []netip.Prefix
+	for _, conflict := range conflicts {
+		if !slices.Contains(res, conflict.Route) {
+			res = append(res, conflict.Route)
+		}
+	}
+	slices.SortFunc(res, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	})
+	return res
+}
+
+// checkRouteConflicts checks whether route overlaps a subnet route of a peer,
+// which is an error if skip is set and a warning otherwise
+func checkRouteConflicts(route netip.Prefix, status *ipnstate.Status, skip bool) error {
+	for _, conflict := range routeConflicts([]netip.Prefix{route}, status) {
+		if skip {
+			return fmt.Errorf("%s overlaps route %s of %s", route, conflict.PeerRoute, conflict.Peer)
+		}
+		warnRouteConflict(conflict, false)
+	}
+	return nil
+}
+
+// warnRouteConflict logs a warning about a conflicting route, which is
+// withheld if skipped is set
+func warnRouteConflict(conflict routeConflict, skipped bool) {
+	if skipped {
+		slog.Warn("Not advertising route that overlaps another node's route", "route", conflict.Route, "peer", conflict.Peer, "peer_route", conflict.PeerRoute)
+		return
+	}
+	slog.Warn("Advertised route overlaps another node's route, clients may route traffic inconsistently", "route", conflict.Route, "peer", conflict.Peer, "peer_route", conflict.PeerRoute)
+}
+
+// HealthMonitor reports whether the upstream is healthy
+type HealthMonitor interface {
+	Healthy() bool
+	SetHealthListener(func(healthy bool))
+}
+
+// routeClient is the part of the Tailscale local client that a
+// RouteAdvertiser uses
+type routeClient interface {
+	EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error)
+	Status(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// RouteAdvertiser advertises the node as an app connector along with its
+// routes, which can be withheld for various reasons (e.g. while the upstream
+// is unhealthy)
+type RouteAdvertiser struct {
+	lc       routeClient
+	excluded prefixSet
+	saveTo   string
+	// debounce is how long changes to the withheld reasons are collected for
+	// before being applied together
+	debounce time.Duration
+
+	mutex    sync.Mutex
+	routes   []netip.Prefix
+	withheld map[string]bool
+	pending  *time.Timer
+	// conflicting are the routes withheld because they overlap another
+	// node's routes, while the rest are still advertised
+	conflicting []netip.Prefix
+
+	// advertised is the route set last sent to the node's preferences, and
+	// applied is whether they're known to still hold it
+	advertised []netip.Prefix
+	applied    bool
+
+	// triggers describe the changes that haven't been applied yet
+	triggers    []string
+	history     []RouteChange
+	historySize int
+	webhook     string
+
+	// state is the last state seen on the IPN bus
+	state ipn.State
+}
+
+// RouteChange is a change to the routes the node advertises
+type RouteChange struct {
+	Time    time.Time      `json:"time"`
+	Added   []netip.Prefix `json:"added"`
+	Removed []netip.Prefix `json:"removed"`
+	Trigger string         `json:"trigger"`
+}
+
+// routeNotification is the body sent to the routes webhook
+type routeNotification struct {
+	Hostname string         `json:"hostname"`
+	Routes   []netip.Prefix `json:"routes"`
+	RouteChange
+}
+
+// Apply sets the node's preferences to advertise its routes, or no routes if
+// they are being withheld for any reason, even if they should already be set.
+// The trigger describes why, for the route history.
+func (a *RouteAdvertiser) Apply(ctx context.Context, trigger string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.applied = false
+	a.triggers = append(a.triggers, trigger)
+	return a.apply(ctx)
+}
+
+// apply updates the node's preferences if the routes it should advertise have
+// changed since they were last applied. The mutex must be held.
+func (a *RouteAdvertiser) apply(ctx context.Context) error {
+	var routes []netip.Prefix
+	if len(a.withheld) == 0 {
+		routes = slices.DeleteFunc(slices.Clone(a.routes), func(route netip.Prefix) bool {
+			return slices.Contains(a.conflicting, route)
+		})
+	}
+	if a.applied && slices.Equal(routes, a.advertised) {
+		a.triggers = nil
+		return nil
+	}
+
+	_, err := a.lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			AppConnector: ipn.AppConnectorPrefs{
+				Advertise: true,
+			},
+			AdvertiseRoutes: routes,
+		},
+		AppConnectorSet:    true,
+		AdvertiseRoutesSet: true,
+	})
+	if err != nil {
+		a.applied = false
+		return err
+	}
+
+	a.recordChange(a.advertised, routes, strings.Join(a.triggers, ", "))
+	a.advertised = slices.Clone(routes)
+	a.applied = true
+	a.triggers = nil
+	return nil
+}
+
+// recordChange adds the difference between two route sets to the history,
+// and sends it to the webhook. The mutex must be held.
+func (a *RouteAdvertiser) recordChange(previous, routes []netip.Prefix, trigger string) {
+	change := RouteChange{Time: time.Now(), Added: []netip.Prefix{}, Removed: []netip.Prefix{}, Trigger: trigger}
+	for _, route := range routes {
+		if !slices.Contains(previous, route) {
+			change.Added = append(change.Added, route)
+		}
+	}
+	for _, route := range previous {
+		if !slices.Contains(routes, route) {
+			change.Removed = append(change.Removed, route)
+		}
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+
+	if a.historySize > 0 {
+		a.history = append(a.history, change)
+		if len(a.history) > a.historySize {
+			a.history = slices.Delete(a.history, 0, len(a.history)-a.historySize)
+		}
+	}
+
+	if a.webhook != "" {
+		notification := routeNotification{Hostname: *tsHostname, Routes: slices.Clone(routes), RouteChange: change}
+		if notification.Routes == nil {
+			notification.Routes = []netip.Prefix{}
+		}
+		go func() {
+			if err := postWebhook(context.Background(), a.webhook, notification); err != nil {
+				slog.Error("Failed to call routes webhook", "error", err)
+			}
+		}()
+	}
+}
+
+// History returns the most recent changes to the advertised routes, oldest
+// first
+func (a *RouteAdvertiser) History() []RouteChange {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return slices.Clone(a.history)
+}
+
+// scheduleApply applies the routes once the debounce period has passed, so
+// that changes in the meantime are applied together. The mutex must be held.
+func (a *RouteAdvertiser) scheduleApply(delay time.Duration) {
+	if a.pending != nil {
+		return
+	}
+	a.pending = time.AfterFunc(delay, a.applyPending)
+}
+
+// applyPending applies changes collected by scheduleApply, trying again later
+// if that fails
+func (a *RouteAdvertiser) applyPending() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.pending = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := a.apply(ctx); err != nil {
+		slog.Error("Failed to update advertised routes, retrying", "error", err)
+		a.scheduleApply(10 * time.Second)
+	}
+}
+
+// SetWithheld sets whether routes are withheld for the given reason, and
+// applies the change (after the debounce period, if there is one)
+func (a *RouteAdvertiser) SetWithheld(ctx context.Context, reason string, withheld bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.withheld[reason] == withheld {
+		return nil
+	}
+	if withheld {
+		if a.withheld == nil {
+			a.withheld = make(map[string]bool)
+		}
+		a.withheld[reason] = true
+	} else {
+		delete(a.withheld, reason)
+	}
+
+	if withheld {
+		a.triggers = append(a.triggers, "withheld ("+reason+")")
+	} else {
+		a.triggers = append(a.triggers, "released ("+reason+")")
+	}
+	if a.debounce > 0 {
+		a.scheduleApply(a.debounce)
+		return nil
+	}
+	return a.apply(ctx)
+}
+
+// checkConflicts warns about any conflicts between the configured routes and
+// those of other nodes that aren't in previous, and withholds the conflicting
+// routes if they're being skipped. It returns the current conflicts.
+func (a *RouteAdvertiser) checkConflicts(ctx context.Context, previous []routeConflict) ([]routeConflict, error) {
+	status, err := a.lc.Status(ctx)
+	if err != nil {
+		return previous, err
+	}
+
+	conflicts := routeConflicts(a.Settings().Routes, status)
+	for _, conflict := range conflicts {
+		if !slices.Contains(previous, conflict) {
+			warnRouteConflict(conflict, *tsSkipConflictingRoutes)
+		}
+	}
+
+	if *tsSkipConflictingRoutes {
+		if err := a.SetConflicting(ctx, conflictingRoutes(conflicts)); err != nil {
+			return conflicts, fmt.Errorf("failed to withhold conflicting routes: %w", err)
+		}
+	}
+	return conflicts, nil
+}
+
+// SetConflicting sets the routes withheld because they overlap another node's
+// routes, and applies the change (after the debounce period, if there is one)
+func (a *RouteAdvertiser) SetConflicting(ctx context.Context, routes []netip.Prefix) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if slices.Equal(routes, a.conflicting) {
+		return nil
+	}
+	for _, route := range routes {
+		if !slices.Contains(a.conflicting, route) {
+			a.triggers = append(a.triggers, "conflict ("+route.String()+")")
+		}
+	}
+	for _, route := range a.conflicting {
+		if !slices.Contains(routes, route) {
+			slog.Info("Route no longer overlaps another node's route", "route", route)
+			a.triggers = append(a.triggers, "conflict resolved ("+route.String()+")")
+		}
+	}
+	a.conflicting = slices.Clone(routes)
+
+	if a.debounce > 0 {
+		a.scheduleApply(a.debounce)
+		return nil
+	}
+	return a.apply(ctx)
+}
+
+// RouteSettings describes the routes a node is configured to advertise
+type RouteSettings struct {
+	Routes      []netip.Prefix `json:"routes"`
+	ExitNode    bool           `json:"exit_node"`
+	Withheld    []string       `json:"withheld"`
+	Conflicting []netip.Prefix `json:"conflicting"`
+}
+
+// Settings returns the routes the node is configured to advertise, the
+// reasons they are being withheld (if any), and any withheld because they
+// conflict with other nodes' routes
+func (a *RouteAdvertiser) Settings() RouteSettings {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	settings := RouteSettings{
+		Routes:      slices.Clone(a.routes),
+		ExitNode:    isExitNode(a.routes),
+		Withheld:    []string{},
+		Conflicting: append([]netip.Prefix{}, a.conflicting...),
+	}
+	for reason := range a.withheld {
+		settings.Withheld = append(settings.Withheld, reason)
+	}
+	slices.Sort(settings.Withheld)
+	return settings
+}
+
+// AddRoute starts advertising an extra route
+func (a *RouteAdvertiser) AddRoute(ctx context.Context, route netip.Prefix) error {
+	if err := checkExtraRoute(route, a.excluded); err != nil {
+		return err
+	}
+
+	if status, err := a.lc.Status(ctx); err != nil {
+		slog.Warn("Failed to check for route conflicts", "error", err)
+	} else if err := checkRouteConflicts(route, status, *tsSkipConflictingRoutes); err != nil {
+		return err
+	}
+
+	return a.update(ctx, "added "+route.String(), func(routes []netip.Prefix) []netip.Prefix {
+		if slices.Contains(routes, route) {
+			return routes
+		}
+		return append(routes, route)
+	})
+}
+
+// RemoveRoute stops advertising an extra route
+func (a *RouteAdvertiser) RemoveRoute(ctx context.Context, route netip.Prefix) error {
+	if slices.Contains(exitNodeRoutes, route) {
+		return fmt.Errorf("%s is an exit node route, disable the exit node instead", route)
+	}
+
+	return a.update(ctx, "removed "+route.String(), func(routes []netip.Prefix) []netip.Prefix {
+		return slices.DeleteFunc(routes, func(p netip.Prefix) bool {
+			return p == route
+		})
+	})
+}
+
+// SetExitNode sets whether the exit node routes are advertised
+func (a *RouteAdvertiser) SetExitNode(ctx context.Context, enabled bool) error {
+	trigger := "disabled exit node"
+	if enabled {
+		trigger = "enabled exit node"
+	}
+	return a.update(ctx, trigger, func(routes []netip.Prefix) []netip.Prefix {
+		routes = slices.DeleteFunc(routes, func(p netip.Prefix) bool {
+			return slices.Contains(exitNodeRoutes, p)
+		})
+		if enabled {
+			routes = append(slices.Clone(exitNodeRoutes), routes...)
+		}
+		return routes
+	})
+}
+
+// update changes the configured routes, applying and saving them if they
+// differ from the current routes. The trigger describes the change for the
+// route history.
+func (a *RouteAdvertiser) update(ctx context.Context, trigger string, change func([]netip.Prefix) []netip.Prefix) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	previous := a.routes
+	routes := change(slices.Clone(previous))
+	if slices.Equal(routes, previous) {
+		return nil
+	}
+
+	a.routes = routes
+	pendingTriggers := len(a.triggers)
+	a.triggers = append(a.triggers, trigger)
+	if err := a.apply(ctx); err != nil {
+		a.routes = previous
+		a.triggers = a.triggers[:pendingTriggers]
+		return fmt.Errorf("failed to advertise routes: %w", err)
+	}
+
+	slog.Info("Advertised routes changed", "routes", routes)
+	if a.saveTo != "" {
+		if err := saveRoutes(a.saveTo, routes); err != nil {
+			return fmt.Errorf("routes changed but couldn't be saved: %w", err)
+		}
+	}
+	return nil
+}
+
+// isExitNode returns whether routes include the exit node routes
+func isExitNode(routes []netip.Prefix) bool {
+	for _, route := range exitNodeRoutes {
+		if !slices.Contains(routes, route) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkExtraRoute checks that route can be advertised as an extra route
+func checkExtraRoute(route netip.Prefix, excluded prefixSet) error {
+	switch {
+	case !route.IsValid() || route != route.Masked():
+		return fmt.Errorf("%s isn't a valid network prefix", route)
+	case route.Bits() == 0:
+		return fmt.Errorf("%s is an exit node route, enable the exit node instead", route)
+	case tailscaleRoutes.overlaps(route):
+		return fmt.Errorf("%s overlaps Tailscale's own addresses", route)
+	case excluded.covers(route):
+		return fmt.Errorf("%s is excluded or reserved", route)
+	}
+	return nil
+}
+
+// validSavedRoutes drops any saved routes that would no longer be allowed
+// as extra routes, e.g. because --exclude-ips has changed since they were
+// saved. The exit node routes are kept.
+func validSavedRoutes(saved []netip.Prefix, excluded prefixSet) []netip.Prefix {
+	return slices.DeleteFunc(slices.Clone(saved), func(route netip.Prefix) bool {
+		if slices.Contains(exitNodeRoutes, route) {
+			return false
+		}
+		if err := checkExtraRoute(route, excluded); err != nil {
+			slog.Warn("Not advertising saved route", "route", route, "error", err)
+			return true
+		}
+		return false
+	})
+}
+
+// loadRoutes reads the routes saved at path, returning nil if none have been
+// saved yet
+func loadRoutes(path string) ([]netip.Prefix, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	routes := []netip.Prefix{}
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse saved routes: %w", err)
+	}
+	return routes, nil
+}
+
+// saveRoutes atomically writes routes to path
+func saveRoutes(path string, routes []netip.Prefix) error {
+	if routes == nil {
+		// Make sure "no routes" isn't saved as null, which reads back as nothing saved
+		routes = []netip.Prefix{}
+	}
+
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// healthChanged advertises or withholds routes when the upstream's health
+// changes
+func (a *RouteAdvertiser) healthChanged(healthy bool) {
+	if !healthy && !*tsWithdrawUnhealthy {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if healthy {
+		slog.Info("Upstream is healthy, advertising routes")
+	} else {
+		slog.Warn("Upstream is unhealthy, withdrawing routes")
+	}
+
+	if err := a.SetWithheld(ctx, "unhealthy", !healthy); err != nil {
+		slog.Error("Failed to update advertised routes", "error", err)
+	}
+}
+
+// handle re-applies the node's preferences whenever it returns to the running
+// state (e.g. after a control plane outage or logging in again), in case they
+// were lost while it was disconnected
+func (a *RouteAdvertiser) handle(ctx context.Context, n ipn.Notify) {
+	if n.State == nil {
+		return
+	}
+
+	previous := a.state
+	a.state = *n.State
+	if a.state != ipn.Running || previous == ipn.NoState || previous == ipn.Running {
+		return
+	}
+
+	slog.Info("Tailscale node is running again, re-advertising routes", "previous_state", previous.String())
+	if err := a.Apply(ctx, "reconnected"); err != nil {
+		slog.Error("Failed to re-advertise routes", "error", err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+func TestUnapprovedRoutes(t *testing.T) {
+	advertised := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"), netip.MustParsePrefix("203.0.113.0/24")}
+
+	tests := []struct {
+		name    string
+		allowed []netip.Prefix
+		want    []netip.Prefix
+	}{
+		{
+			name:    "nothing approved",
+			allowed: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			want:    advertised,
+		},
+		{
+			name:    "some approved",
+			allowed: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			want:    []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		},
+		{
+			name:    "all approved",
+			allowed: append([]netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}, advertised...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unapprovedRoutes(advertised, tt.allowed); !slices.Equal(got, tt.want) {
+				t.Errorf("unapprovedRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	peerRoutes := views.SliceOf([]netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("203.0.113.128/25"),
+	})
+	status := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {HostName: "router", PrimaryRoutes: &peerRoutes},
+			key.NewNode().Public(): {HostName: "laptop"},
+		},
+	}
+
+	routes := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+	}
+
+	want := []routeConflict{{
+		Route:     netip.MustParsePrefix("203.0.113.0/24"),
+		Peer:      "router",
+		PeerRoute: netip.MustParsePrefix("203.0.113.128/25"),
+	}}
+	if got := routeConflicts(routes, status); !slices.Equal(got, want) {
+		t.Errorf("routeConflicts() = %v, want %v", got, want)
+	}
+
+	wantRoutes := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	if got := conflictingRoutes(routeConflicts(routes, status)); !slices.Equal(got, wantRoutes) {
+		t.Errorf("conflictingRoutes() = %v, want %v", got, wantRoutes)
+	}
+
+	conflicting := netip.MustParsePrefix("203.0.113.0/24")
+	if err := checkRouteConflicts(conflicting, status, false); err != nil {
+		t.Errorf("checkRouteConflicts() without skipping error = %v, want nil", err)
+	}
+	if err := checkRouteConflicts(conflicting, status, true); err == nil {
+		t.Error("checkRouteConflicts() when skipping error = nil, want an error")
+	}
+	if err := checkRouteConflicts(netip.MustParsePrefix("198.51.100.0/24"), status, true); err != nil {
+		t.Errorf("checkRouteConflicts() for a route without conflicts error = %v, want nil", err)
+	}
+}
+
+func TestCheckExtraRoute(t *testing.T) {
+	tests := []struct {
+		route   string
+		wantErr bool
+	}{
+		{"8.8.8.0/24", false},
+		{"2606:4700::/32", false},
+		{"8.8.8.1/24", true},
+		{"203.0.113.0/24", true},
+		{"2001:db8::/32", true},
+		{"0.0.0.0/0", true},
+		{"::/0", true},
+		{"100.100.0.0/16", true},
+		{"10.0.0.0/8", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			err := checkExtraRoute(netip.MustParsePrefix(tt.route), bogonRoutes)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkExtraRoute(%s) error = %v, wantErr %v", tt.route, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSavedRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+
+	routes, err := loadRoutes(path)
+	if err != nil || routes != nil {
+		t.Fatalf("loadRoutes() before saving = %v, %v, want nil, nil", routes, err)
+	}
+
+	want := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"), netip.MustParsePrefix("203.0.113.0/24")}
+	if err := saveRoutes(path, want); err != nil {
+		t.Fatalf("saveRoutes() error = %v", err)
+	}
+	routes, err = loadRoutes(path)
+	if err != nil {
+		t.Fatalf("loadRoutes() error = %v", err)
+	}
+	if !slices.Equal(routes, want) {
+		t.Errorf("loadRoutes() = %v, want %v", routes, want)
+	}
+	if !isExitNode(routes) || isExitNode(routes[2:]) {
+		t.Errorf("isExitNode() didn't detect the exit node routes")
+	}
+
+	if err := saveRoutes(path, nil); err != nil {
+		t.Fatalf("saveRoutes() error = %v", err)
+	}
+	routes, err = loadRoutes(path)
+	if err != nil || routes == nil || len(routes) != 0 {
+		t.Errorf("loadRoutes() after saving no routes = %v, %v, want empty", routes, err)
+	}
+}
+
+func TestValidSavedRoutes(t *testing.T) {
+	excluded, err := parsePrefixSet("8.8.4.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded = append(excluded, bogonRoutes...)
+
+	saved := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("8.8.8.0/24"),
+		netip.MustParsePrefix("8.8.4.0/24"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("100.100.0.0/16"),
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("8.8.8.0/24"),
+	}
+	if got := validSavedRoutes(saved, excluded); !slices.Equal(got, want) {
+		t.Errorf("validSavedRoutes() = %v, want %v", got, want)
+	}
+}
+
+// fakeRouteClient records the routes advertised through it
+type fakeRouteClient struct {
+	mutex  sync.Mutex
+	edits  [][]netip.Prefix
+	status *ipnstate.Status
+}
+
+func (c *fakeRouteClient) EditPrefs(_ context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.edits = append(c.edits, mp.AdvertiseRoutes)
+	return &mp.Prefs, nil
+}
+
+func (c *fakeRouteClient) Status(context.Context) (*ipnstate.Status, error) {
+	if c.status == nil {
+		return &ipnstate.Status{}, nil
+	}
+	return c.status, nil
+}
+
+func (c *fakeRouteClient) Edits() [][]netip.Prefix {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.edits)
+}
+
+func TestRouteAdvertiserDebounce(t *testing.T) {
+	ctx := context.Background()
+	routes := slices.Clone(exitNodeRoutes)
+	client := &fakeRouteClient{}
+	advertiser := &RouteAdvertiser{lc: client, debounce: 50 * time.Millisecond, routes: routes}
+
+	if err := advertiser.Apply(ctx, "startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several changes in quick succession are applied together
+	for _, change := range []struct {
+		reason   string
+		withheld bool
+	}{{"unhealthy", true}, {"standby", true}, {"unhealthy", false}} {
+		if err := advertiser.SetWithheld(ctx, change.reason, change.withheld); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	// Changes that leave the advertised routes the same aren't applied
+	if err := advertiser.SetWithheld(ctx, "unhealthy", true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	want := [][]netip.Prefix{routes, nil}
+	if got := client.Edits(); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("advertised routes = %v, want %v", got, want)
+	}
+}
+
+func TestRouteAdvertiserHistory(t *testing.T) {
+	ctx := context.Background()
+	extra := netip.MustParsePrefix("8.8.8.0/24")
+	advertiser := &RouteAdvertiser{lc: &fakeRouteClient{}, routes: slices.Clone(exitNodeRoutes), historySize: 2}
+
+	if err := advertiser.Apply(ctx, "startup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := advertiser.AddRoute(ctx, extra); err != nil {
+		t.Fatal(err)
+	}
+	if err := advertiser.SetWithheld(ctx, "unhealthy", true); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is advertised while withheld, so this isn't a change
+	if err := advertiser.SetExitNode(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	history := advertiser.History()
+	if len(history) != 2 {
+		t.Fatalf("History() has %d changes, want the last 2: %v", len(history), history)
+	}
+	if got := history[0]; got.Trigger != "added 8.8.8.0/24" || !slices.Equal(got.Added, []netip.Prefix{extra}) || len(got.Removed) != 0 {
+		t.Errorf("first change = %+v, want 8.8.8.0/24 added", got)
+	}
+	wantRemoved := append(slices.Clone(exitNodeRoutes), extra)
+	if got := history[1]; got.Trigger != "withheld (unhealthy)" || len(got.Added) != 0 || !slices.Equal(got.Removed, wantRemoved) {
+		t.Errorf("second change = %+v, want all routes removed", got)
+	}
+}
+
+func TestRouteAdvertiserWebhook(t *testing.T) {
+	notifications := make(chan routeNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification routeNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		notifications <- notification
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	extra := netip.MustParsePrefix("8.8.8.0/24")
+	advertiser := &RouteAdvertiser{lc: &fakeRouteClient{}, routes: []netip.Prefix{extra}, webhook: server.URL}
+	if err := advertiser.Apply(ctx, "startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-notifications:
+		if got.Trigger != "startup" || !slices.Equal(got.Added, []netip.Prefix{extra}) || len(got.Removed) != 0 || !slices.Equal(got.Routes, []netip.Prefix{extra}) || got.Time.IsZero() {
+			t.Errorf("webhook received %+v, want 8.8.8.0/24 added at startup", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't called")
+	}
+}
+
+func TestRouteAdvertiserConflicts(t *testing.T) {
+	previous := *tsSkipConflictingRoutes
+	*tsSkipConflictingRoutes = true
+	defer func() { *tsSkipConflictingRoutes = previous }()
+
+	ctx := context.Background()
+	conflicting := netip.MustParsePrefix("8.8.8.0/24")
+	other := netip.MustParsePrefix("1.1.1.0/24")
+	client := &fakeRouteClient{}
+	advertiser := &RouteAdvertiser{lc: client, routes: []netip.Prefix{conflicting, other}}
+	if err := advertiser.Apply(ctx, "startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node starts advertising an overlapping route after startup
+	peerRoutes := views.SliceOf([]netip.Prefix{netip.MustParsePrefix("8.8.8.128/25")})
+	client.status = &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {HostName: "router", PrimaryRoutes: &peerRoutes},
+		},
+	}
+	conflicts, err := advertiser.checkConflicts(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Errorf("checkConflicts() = %v, want one conflict", conflicts)
+	}
+	edits := client.Edits()
+	if got := edits[len(edits)-1]; !slices.Equal(got, []netip.Prefix{other}) {
+		t.Errorf("advertised %v while conflicting, want only %v", got, other)
+	}
+	if got := advertiser.Settings(); !slices.Equal(got.Routes, []netip.Prefix{conflicting, other}) || !slices.Equal(got.Conflicting, []netip.Prefix{conflicting}) {
+		t.Errorf("Settings() = %+v, want %v configured but conflicting", got, conflicting)
+	}
+
+	// The route is advertised again once the other node stops
+	client.status = nil
+	if _, err := advertiser.checkConflicts(ctx, conflicts); err != nil {
+		t.Fatal(err)
+	}
+	edits = client.Edits()
+	if got := edits[len(edits)-1]; !slices.Equal(got, []netip.Prefix{conflicting, other}) {
+		t.Errorf("advertised %v after the conflict was resolved, want both routes", got)
+	}
+	if len(edits) != 3 {
+		t.Errorf("made %d edits, want 3", len(edits))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// secretFlags are the flags holding secrets that can alternatively be read
+// from a file, using the flag of the same name with a "-file" suffix. This
+// keeps them out of process listings and allows using mounted secrets.
+var secretFlags = []string{
+	"wg-private-key",
+	"wg-preshared-key",
+	"wg-provider-account",
+	"tailscale-auth-key",
+	"tailscale-oauth-client-secret",
+	"tailscale-api-key",
+}
+
+// sensitiveFlags are other flags whose values shouldn't be displayed
+var sensitiveFlags = []string{
+	"state-passphrase",
+	"log-privacy-salt",
+	"wg-rotation-servers",
+}
+
+// isSecretFlag returns whether the named flag holds a secret
+func isSecretFlag(name string) bool {
+	return slices.Contains(secretFlags, name) || slices.Contains(sensitiveFlags, name)
+}
+
+// isSecretFileSet returns whether the named secret flag was read from a file
+func isSecretFileSet(fs *flag.FlagSet, name string) bool {
+	file := fs.Lookup(name + "-file")
+	return slices.Contains(secretFlags, name) && file != nil && file.Value.String() != ""
+}
+
+// readSecretFiles sets each secret flag in fs from the file given in its
+// "-file" variant, if any. It is an error to provide both.
+func readSecretFiles(fs *flag.FlagSet) error {
+	var errs []error
+	for _, name := range secretFlags {
+		value, file := fs.Lookup(name), fs.Lookup(name+"-file")
+		if value == nil || file == nil || file.Value.String() == "" {
+			continue
+		}
+
+		if value.Value.String() != "" {
+			errs = append(errs, fmt.Errorf("only one of --%s and --%s may be given", value.Name, file.Name))
+			continue
+		}
+
+		data, err := os.ReadFile(file.Value.String())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read --%s: %w", file.Name, err))
+			continue
+		}
+
+		if err := fs.Set(value.Name, strings.TrimSpace(string(data))); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value in --%s: %w", file.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
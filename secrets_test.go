@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("c2VjcmV0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no file",
+			args: []string{"-wg-private-key=direct"},
+			want: "direct",
+		},
+		{
+			name: "from file",
+			args: []string{"-wg-private-key-file=" + keyFile},
+			want: "c2VjcmV0",
+		},
+		{
+			name:    "both given",
+			args:    []string{"-wg-private-key=direct", "-wg-private-key-file=" + keyFile},
+			want:    "direct",
+			wantErr: "only one of --wg-private-key and --wg-private-key-file",
+		},
+		{
+			name:    "missing file",
+			args:    []string{"-wg-private-key-file=" + filepath.Join(dir, "missing")},
+			wantErr: "failed to read --wg-private-key-file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("wg-private-key", "", "")
+			fs.String("wg-private-key-file", "", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := readSecretFiles(fs)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			if got := fs.Lookup("wg-private-key").Value.String(); got != tt.want {
+				t.Errorf("wg-private-key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+)
+
+// serviceName is the name tsv is installed under as a system service
+const serviceName = "tsv"
+
+// RunService manages tsv as a system service. Arguments after "install" are
+// passed to tsv when the service starts.
+func RunService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tsv service <install [flags...]|uninstall|start|stop>")
+	}
+
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return stopService()
+	default:
+		return fmt.Errorf("unknown service command %q (expected install, uninstall, start or stop)", args[0])
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// systemdUnitPath is where the systemd unit is installed
+const systemdUnitPath = "/etc/systemd/system/" + serviceName + ".service"
+
+// runUntilStopped runs until the process is interrupted or terminated
+func runUntilStopped(run func(ctx context.Context) error) error {
+	return runWithSignals(run)
+}
+
+// installService writes a systemd unit for tsv and enables it
+func installService(args []string) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find tsv binary: %w", err)
+	}
+
+	if _, err := os.Stat(systemdUnitPath); err == nil {
+		return fmt.Errorf("%s already exists", systemdUnitPath)
+	}
+	if err := os.WriteFile(systemdUnitPath, []byte(systemdUnit(binary, args...)), 0644); err != nil {
+		return fmt.Errorf("failed to write systemd unit: %w", err)
+	}
+	slog.Info("Installed systemd unit", "path", systemdUnitPath)
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", serviceName)
+}
+
+// uninstallService stops and removes the systemd unit
+func uninstallService() error {
+	if err := systemctl("disable", "--now", serviceName); err != nil {
+		return err
+	}
+	if err := os.Remove(systemdUnitPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove systemd unit: %w", err)
+	}
+	return systemctl("daemon-reload")
+}
+
+func startService() error {
+	return systemctl("start", serviceName)
+}
+
+func stopService() error {
+	return systemctl("stop", serviceName)
+}
+
+// systemctl runs systemctl with the given arguments
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %v failed: %w", args, err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// runUntilStopped runs until the process is interrupted or terminated
+func runUntilStopped(run func(ctx context.Context) error) error {
+	return runWithSignals(run)
+}
+
+func installService([]string) error {
+	return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
+
+func uninstallService() error {
+	return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
+
+func startService() error {
+	return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
+
+func stopService() error {
+	return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
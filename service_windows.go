@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runUntilStopped runs under the service control manager if tsv was started
+// as a service, or until the process is interrupted otherwise
+func runUntilStopped(run func(ctx context.Context) error) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("failed to determine if running as a service: %w", err)
+	}
+	if !isService {
+		return runWithSignals(run)
+	}
+
+	handler := &windowsService{run: run}
+	if err := svc.Run(serviceName, handler); err != nil {
+		return err
+	}
+	return handler.err
+}
+
+// windowsService adapts a run function to the service control manager
+type windowsService struct {
+	run func(ctx context.Context) error
+	err error
+}
+
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(ctx)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case s.err = <-done:
+			if s.err != nil {
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				slog.Info("Shutting down...")
+				// Allow time for active connections to drain
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((*shutdownGracePeriod + 10*time.Second).Milliseconds())}
+				cancel()
+			}
+		}
+	}
+}
+
+// installService registers tsv with the service control manager
+func installService(args []string) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find tsv binary: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, binary, mgr.Config{
+		DisplayName: "Tailscale VPN gateway",
+		Description: "Connects to Tailscale and sends traffic from the tailnet over a VPN",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	slog.Info("Installed service", "name", serviceName)
+	return nil
+}
+
+// uninstallService stops and removes the service
+func uninstallService() error {
+	return withService(func(s *mgr.Service) error {
+		if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+			if _, err := s.Control(svc.Stop); err != nil {
+				return fmt.Errorf("failed to stop service: %w", err)
+			}
+		}
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to delete service: %w", err)
+		}
+		return nil
+	})
+}
+
+func startService() error {
+	return withService(func(s *mgr.Service) error {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start service: %w", err)
+		}
+		return nil
+	})
+}
+
+func stopService() error {
+	return withService(func(s *mgr.Service) error {
+		if _, err := s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+		return nil
+	})
+}
+
+// withService calls fn with the installed tsv service
+func withService(fn func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to open service: %w", err)
+	}
+	defer s.Close()
+
+	return fn(s)
+}
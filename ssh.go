@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sshAddress        = flag.String("ssh-address", "", "SSH server to tunnel through when using the ssh upstream (host:port)")
+	sshUser           = flag.String("ssh-user", "", "SSH username")
+	sshPrivateKeyFile = flag.String("ssh-private-key-file", "", "Path to the SSH private key")
+	sshHostKey        = flag.String("ssh-host-key", "", "SSH server's public host key, in authorized_keys format (e.g. 'ssh-ed25519 AAAA...')")
+)
+
+// SSHDialer is a Dialer that opens connections through an SSH server using
+// direct-tcpip channels, reconnecting to the server as required
+type SSHDialer struct {
+	config  *ssh.ClientConfig
+	address string
+
+	mutex  sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// NewSSHDialer creates a new SSH dialer and connects to the SSH server
+func NewSSHDialer() (*SSHDialer, error) {
+	config, err := sshClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &SSHDialer{
+		address: *sshAddress,
+		config:  config,
+	}
+
+	if _, err := d.connect(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// sshClientConfig creates the SSH client configuration from the command line flags
+func sshClientConfig() (*ssh.ClientConfig, error) {
+	keyBytes, err := os.ReadFile(*sshPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH private key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(*sshHostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH host key: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            *sshUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// DialContext opens a connection to address through the SSH server
+func (d *SSHDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.DialContext(ctx, network, address)
+}
+
+// Close disconnects from the SSH server
+func (d *SSHDialer) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.closed = true
+	if d.client != nil {
+		return d.client.Close()
+	}
+	return nil
+}
+
+// connect returns the current SSH client, establishing a new connection if
+// there isn't one
+func (d *SSHDialer) connect() (*ssh.Client, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return nil, errors.New("ssh dialer is closed")
+	}
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	client, err := ssh.Dial("tcp", d.address, d.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server: %w", err)
+	}
+
+	slog.Info("Connected to SSH server", "address", d.address)
+	d.client = client
+	go d.keepalive(client)
+	return client, nil
+}
+
+// keepalive periodically checks the SSH connection is still responsive, and
+// discards the client once it isn't so the next dial reconnects
+func (d *SSHDialer) keepalive(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				continue
+			}
+			_ = client.Close()
+		}
+
+		d.mutex.Lock()
+		if d.client == client {
+			d.client = nil
+			if !d.closed {
+				slog.Warn("Lost connection to SSH server", "address", d.address)
+			}
+		}
+		d.mutex.Unlock()
+		return
+	}
+}
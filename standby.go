@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"strings"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var (
+	standbyFor         = flag.String("standby-for", "", "Hostname of the active tsv node to stand by for; routes are only advertised while it is offline")
+	standbyGracePeriod = flag.Duration("standby-grace-period", time.Minute, "How long the active node must be offline before the standby takes over")
+)
+
+// MonitorActiveNode periodically checks whether the active node is online,
+// advertising routes once it has been offline for the grace period and
+// withdrawing them again when it comes back
+func MonitorActiveNode(ctx context.Context, lc *local.Client, advertiser *RouteAdvertiser) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	lastSeen := time.Now()
+	active := false
+	for {
+		status, err := lc.Status(ctx)
+		if err != nil {
+			slog.Warn("Failed to check on the active node", "error", err)
+		} else {
+			if activeNodeOnline(status, *standbyFor) {
+				lastSeen = time.Now()
+			}
+
+			shouldBeActive := time.Since(lastSeen) >= *standbyGracePeriod
+			if shouldBeActive != active {
+				if shouldBeActive {
+					slog.Warn("Active node is offline, taking over its routes", "active", *standbyFor, "last_seen", lastSeen)
+				} else {
+					slog.Info("Active node is back online, withdrawing routes", "active", *standbyFor)
+				}
+
+				if err := advertiser.SetWithheld(ctx, "standby", !shouldBeActive); err != nil {
+					slog.Error("Failed to update advertised routes", "error", err)
+				} else {
+					active = shouldBeActive
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// activeNodeOnline returns whether a peer with the given hostname or DNS name
+// is online
+func activeNodeOnline(status *ipnstate.Status, name string) bool {
+	for _, peer := range status.Peer {
+		dnsName := strings.TrimSuffix(peer.DNSName, ".")
+		if strings.EqualFold(peer.HostName, name) || strings.EqualFold(dnsName, name) || strings.EqualFold(strings.Split(dnsName, ".")[0], name) {
+			if peer.Online {
+				return true
+			}
+		}
+	}
+	return false
+}
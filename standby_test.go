@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestActiveNodeOnline(t *testing.T) {
+	status := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {HostName: "tsv", DNSName: "tsv.tail1234.ts.net.", Online: true},
+			key.NewNode().Public(): {HostName: "tsv-old", DNSName: "tsv-old.tail1234.ts.net.", Online: false},
+		},
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"tsv", true},
+		{"TSV", true},
+		{"tsv.tail1234.ts.net", true},
+		{"tsv-old", false},
+		{"missing", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activeNodeOnline(status, tt.name); got != tt.want {
+				t.Errorf("activeNodeOnline(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
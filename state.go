@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	statePassphrase = flag.String("state-passphrase", "", "Passphrase used to encrypt and decrypt exported tsnet state, and the state directory with --tailscale-encrypt-state")
+)
+
+const (
+	stateMagic      = "TSVSTATE1"
+	stateSaltLength = 16
+	stateIterations = 600_000
+)
+
+// ExportState writes the contents of the tsnet state directory to an
+// encrypted archive at path
+func ExportState(dir, path, passphrase string) error {
+	archive, err := archiveDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to archive state directory: %w", err)
+	}
+
+	salt := make([]byte, stateSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	aead, err := stateCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	out, err := sealState(aead, stateMagic, salt, archive)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, out, 0600)
+}
+
+// ImportState decrypts an archive created by ExportState and extracts it into
+// the tsnet state directory. It refuses to overwrite an existing node identity.
+func ImportState(path, dir, passphrase string) error {
+	if _, err := os.Stat(filepath.Join(dir, plainStateFile)); err == nil {
+		return fmt.Errorf("state directory %s already contains a tailscale node", dir)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, encryptedStateFile)); err == nil {
+		return fmt.Errorf("state directory %s already contains a tailscale node", dir)
+	}
+
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	salt, sealed, err := splitSealedState(stateMagic, in)
+	if err != nil {
+		return fmt.Errorf("not a tsv state archive: %w", err)
+	}
+
+	aead, err := stateCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	archive, err := openSealedState(aead, stateMagic, sealed)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt state archive: %w", err)
+	}
+
+	return extractArchive(archive, dir)
+}
+
+// sealState encrypts plaintext, returning it prefixed with the magic string,
+// the salt used to derive the key, and a random nonce
+func sealState(aead cipher.AEAD, magic string, salt, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(magic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(magic)), nil
+}
+
+// splitSealedState returns the salt and remaining sealed data from the output
+// of sealState
+func splitSealedState(magic string, in []byte) (salt, sealed []byte, err error) {
+	if !bytes.HasPrefix(in, []byte(magic)) || len(in) < len(magic)+stateSaltLength {
+		return nil, nil, errors.New("unrecognised format")
+	}
+	in = in[len(magic):]
+	return in[:stateSaltLength], in[stateSaltLength:], nil
+}
+
+// openSealedState decrypts the sealed data returned by splitSealedState
+func openSealedState(aead cipher.AEAD, magic string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("data is truncated")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(magic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted data")
+	}
+	return plaintext, nil
+}
+
+// stateCipher derives an AES-GCM cipher from the passphrase and salt
+func stateCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("a passphrase is required")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, stateIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// archiveDir creates a gzipped tarball of all regular files within dir
+func archiveDir(dir string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Name: filepath.ToSlash(rel),
+			Mode: 0600,
+			Size: int64(len(content)),
+		}); err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// extractArchive extracts a gzipped tarball created by archiveDir into dir
+func extractArchive(archive []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Use an os.Root so that archive entries can't escape the directory
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(header.Name)
+		if err := root.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return err
+		}
+
+		f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestStateExportImport(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "tailscaled.state"), []byte("node-identity"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "certs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "certs", "cert.pem"), []byte("cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "state.tsv")
+	if err := ExportState(src, archive, "hunter2"); err != nil {
+		t.Fatalf("ExportState() error = %v", err)
+	}
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		if err := ImportState(archive, t.TempDir(), "hunter3"); err == nil {
+			t.Errorf("ImportState() expected error with wrong passphrase")
+		}
+	})
+
+	t.Run("existing node", func(t *testing.T) {
+		if err := ImportState(archive, src, "hunter2"); err == nil {
+			t.Errorf("ImportState() expected error when overwriting existing state")
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "config")
+		if err := ImportState(archive, dst, "hunter2"); err != nil {
+			t.Fatalf("ImportState() error = %v", err)
+		}
+
+		for name, want := range map[string]string{
+			"tailscaled.state":                 "node-identity",
+			filepath.Join("certs", "cert.pem"): "cert",
+		} {
+			got, err := os.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Errorf("failed to read %s: %v", name, err)
+				continue
+			}
+			if string(got) != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	})
+}
+
+func TestEncryptedStateStore(t *testing.T) {
+	dir := t.TempDir()
+	plain := `{"_machinekey":"bWFjaGluZS1rZXk=","profile-abcd":"cHJvZmlsZQ=="}`
+	if err := os.WriteFile(filepath.Join(dir, plainStateFile), []byte(plain), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newEncryptedStateStore(dir, "hunter2")
+	if err != nil {
+		t.Fatalf("newEncryptedStateStore() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, plainStateFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected unencrypted state to be removed, got %v", err)
+	}
+	current := []byte("profile-abcd")
+	if err := store.WriteState("_current-profile", current); err != nil {
+		t.Fatal(err)
+	}
+	// The store keeps its own copy, so the caller can reuse the slice
+	copy(current, "xxxxxxxxxxxx")
+	if got, err := store.ReadState("_current-profile"); err != nil || string(got) != "profile-abcd" {
+		t.Errorf("ReadState(_current-profile) after reusing the written slice = %q, %v", got, err)
+	}
+
+	encrypted, err := os.ReadFile(filepath.Join(dir, encryptedStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte("profile-abcd")) {
+		t.Error("encrypted state contains plaintext")
+	}
+
+	if _, err := newEncryptedStateStore(dir, "hunter3"); err == nil {
+		t.Error("expected an error with the wrong passphrase")
+	}
+
+	reopened, err := newEncryptedStateStore(dir, "hunter2")
+	if err != nil {
+		t.Fatalf("newEncryptedStateStore() error = %v", err)
+	}
+	for key, want := range map[ipn.StateKey]string{
+		"_machinekey":      "machine-key",
+		"profile-abcd":     "profile",
+		"_current-profile": "profile-abcd",
+	} {
+		got, err := reopened.ReadState(key)
+		if err != nil || string(got) != want {
+			t.Errorf("ReadState(%s) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+	if _, err := reopened.ReadState("missing"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Errorf("ReadState(missing) error = %v, want ErrStateNotExist", err)
+	}
+}
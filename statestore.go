@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"tailscale.com/ipn"
+)
+
+var (
+	tsEncryptState = flag.Bool("tailscale-encrypt-state", false, "Encrypt the tsnet state, including the node and machine keys, at rest using --state-passphrase (requires --tailscale-config-dir)")
+)
+
+const (
+	storeMagic         = "TSVSTORE1"
+	encryptedStateFile = "tailscaled.state.enc"
+	plainStateFile     = "tailscaled.state"
+)
+
+// encryptedStateStore is an ipn.StateStore that holds state in memory, and
+// persists it to a file encrypted with a key derived from a passphrase. Only
+// the state goes through the store: other files tsnet keeps in its directory,
+// such as TLS certificates and their keys, are still written unencrypted.
+type encryptedStateStore struct {
+	path string
+	salt []byte
+	aead cipher.AEAD
+
+	mutex sync.Mutex
+	state map[ipn.StateKey][]byte
+}
+
+// newEncryptedStateStore opens the encrypted state in dir, creating it if it
+// doesn't exist. Existing unencrypted state is encrypted and then removed.
+func newEncryptedStateStore(dir, passphrase string) (*encryptedStateStore, error) {
+	store := &encryptedStateStore{
+		path:  filepath.Join(dir, encryptedStateFile),
+		state: make(map[ipn.StateKey][]byte),
+	}
+
+	in, err := os.ReadFile(store.path)
+	switch {
+	case err == nil:
+		salt, sealed, err := splitSealedState(storeMagic, in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encrypted state: %w", err)
+		}
+		if store.aead, err = stateCipher(passphrase, salt); err != nil {
+			return nil, err
+		}
+		store.salt = salt
+
+		plaintext, err := openSealedState(store.aead, storeMagic, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt state: %w", err)
+		}
+		if err := json.Unmarshal(plaintext, &store.state); err != nil {
+			return nil, fmt.Errorf("failed to parse decrypted state: %w", err)
+		}
+		return store, nil
+
+	case errors.Is(err, os.ErrNotExist):
+		store.salt = make([]byte, stateSaltLength)
+		if _, err := rand.Read(store.salt); err != nil {
+			return nil, err
+		}
+		if store.aead, err = stateCipher(passphrase, store.salt); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return store, store.migrate(filepath.Join(dir, plainStateFile))
+
+	default:
+		return nil, err
+	}
+}
+
+// migrate encrypts existing unencrypted state at path, and removes it
+func (s *encryptedStateStore) migrate(path string) error {
+	in, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(in, &s.state); err != nil {
+		return fmt.Errorf("failed to parse existing state: %w", err)
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+
+	slog.Info("Encrypted existing Tailscale state", "path", s.path)
+	return os.Remove(path)
+}
+
+// ReadState returns the state stored for id
+func (s *encryptedStateStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bs, ok := s.state[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return slices.Clone(bs), nil
+}
+
+// WriteState stores a copy of the state for id, and persists all state to
+// disk. Callers may reuse bs afterwards.
+func (s *encryptedStateStore) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state[id] = slices.Clone(bs)
+	return s.save()
+}
+
+// save encrypts the state and atomically replaces the file on disk
+func (s *encryptedStateStore) save() error {
+	plaintext, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	out, err := sealState(s.aead, storeMagic, s.salt, plaintext)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
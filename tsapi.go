@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+var (
+	tsAPIKey     = flag.String("tailscale-api-key", "", "Tailscale API access token, used instead of the OAuth client secret for API calls")
+	tsAPIKeyFile = flag.String("tailscale-api-key-file", "", "Path to a file containing the Tailscale API access token (alternative to --tailscale-api-key)")
+)
+
+// TailscaleAPI is a minimal client for the Tailscale HTTP API, authenticated
+// using an OAuth client secret
+type TailscaleAPI struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewTailscaleAPI creates a new API client from an OAuth client secret. The
+// secret may carry a baseURL attribute (e.g. `tskey-client-xxx?baseURL=...`)
+// in the same way as the tailscale CLI accepts.
+func NewTailscaleAPI(ctx context.Context, clientSecret string) (*TailscaleAPI, error) {
+	secret, attrs, _ := strings.Cut(clientSecret, "?")
+	values, err := url.ParseQuery(attrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAuth client secret attributes: %w", err)
+	}
+
+	baseURL := values.Get("baseURL")
+	if baseURL == "" {
+		baseURL = "https://api.tailscale.com"
+	}
+
+	// The API identifies the client from the secret, but the ID can't be
+	// blank, so this uses the same placeholder as tsnet
+	credentials := clientcredentials.Config{
+		ClientID:     "some-client-id",
+		ClientSecret: secret,
+		TokenURL:     baseURL + "/api/v2/oauth/token",
+	}
+
+	return &TailscaleAPI{
+		client:  credentials.Client(ctx),
+		baseURL: baseURL,
+	}, nil
+}
+
+// NewTailscaleAPIKey creates a new API client authenticated with an API
+// access token
+func NewTailscaleAPIKey(apiKey string) *TailscaleAPI {
+	return &TailscaleAPI{
+		client:  &http.Client{Transport: &bearerTransport{token: apiKey}},
+		baseURL: "https://api.tailscale.com",
+	}
+}
+
+// newConfiguredTailscaleAPI creates an API client using the API key if one
+// is set, and the OAuth client secret otherwise
+func newConfiguredTailscaleAPI(ctx context.Context) (*TailscaleAPI, error) {
+	switch {
+	case *tsAPIKey != "":
+		return NewTailscaleAPIKey(*tsAPIKey), nil
+	case *tsOAuthClientSecret != "":
+		return NewTailscaleAPI(ctx, *tsOAuthClientSecret)
+	default:
+		return nil, fmt.Errorf("no Tailscale API credentials configured")
+	}
+}
+
+// bearerTransport adds a bearer token to each request
+type bearerTransport struct {
+	token string
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// SetDeviceRoutes sets the routes that are approved for a device
+func (a *TailscaleAPI) SetDeviceRoutes(ctx context.Context, deviceID string, routes []netip.Prefix) error {
+	body := map[string]any{
+		"routes": routes,
+	}
+	if err := a.do(ctx, http.MethodPost, "/api/v2/device/"+url.PathEscape(deviceID)+"/routes", body, nil); err != nil {
+		return fmt.Errorf("failed to set device routes: %w", err)
+	}
+	return nil
+}
+
+// CreateAuthKey mints a new single-use auth key for the given tags
+func (a *TailscaleAPI) CreateAuthKey(ctx context.Context, tags []string, ephemeral, preauthorized bool) (string, error) {
+	body := map[string]any{
+		"capabilities": map[string]any{
+			"devices": map[string]any{
+				"create": map[string]any{
+					"reusable":      false,
+					"ephemeral":     ephemeral,
+					"preauthorized": preauthorized,
+					"tags":          tags,
+				},
+			},
+		},
+		"expirySeconds": 300,
+		"description":   "tsv",
+	}
+
+	var res struct {
+		Key string `json:"key"`
+	}
+	if err := a.do(ctx, http.MethodPost, "/api/v2/tailnet/-/keys", body, &res); err != nil {
+		return "", fmt.Errorf("failed to create auth key: %w", err)
+	}
+	return res.Key, nil
+}
+
+// do performs an API request, encoding body (if non-nil) and decoding the
+// response into res (if non-nil)
+func (a *TailscaleAPI) do(ctx context.Context, method, path string, body, res any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if res != nil {
+		return json.NewDecoder(resp.Body).Decode(res)
+	}
+	return nil
+}
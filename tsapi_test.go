@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSetDeviceRoutes(t *testing.T) {
+	var got []netip.Prefix
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tskey-api-test" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v2/device/nABC123/routes" {
+			http.NotFound(w, r)
+			return
+		}
+
+		var body struct {
+			Routes []netip.Prefix `json:"routes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = body.Routes
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	api := NewTailscaleAPIKey("tskey-api-test")
+	api.baseURL = server.URL
+
+	want := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	if err := api.SetDeviceRoutes(context.Background(), "nABC123", want); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("routes = %v, want %v", got, want)
+	}
+
+	if err := api.SetDeviceRoutes(context.Background(), "nOTHER", want); err == nil {
+		t.Error("expected an error for an unknown device")
+	}
+}
+
+func TestCreateAuthKey(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/oauth/token":
+			id, secret, ok := r.BasicAuth()
+			if !ok {
+				_ = r.ParseForm()
+				id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+			}
+			if id == "" || secret != "tskey-client-test" {
+				http.Error(w, "unauthorised", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+		case "/api/v2/tailnet/-/keys":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorised", http.StatusUnauthorized)
+				return
+			}
+			var body struct {
+				Capabilities struct {
+					Devices struct {
+						Create map[string]any `json:"create"`
+					} `json:"devices"`
+				} `json:"capabilities"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			got = body.Capabilities.Devices.Create
+			_, _ = w.Write([]byte(`{"key":"tskey-auth-test"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	api, err := NewTailscaleAPI(context.Background(), "tskey-client-test?baseURL="+server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := api.CreateAuthKey(context.Background(), []string{"tag:vpn"}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "tskey-auth-test" {
+		t.Errorf("CreateAuthKey() = %q, want tskey-auth-test", key)
+	}
+	if got["ephemeral"] != true || got["preauthorized"] != false {
+		t.Errorf("requested key %v, want ephemeral and not pre-authorised", got)
+	}
+}
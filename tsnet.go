@@ -2,25 +2,72 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"tailscale.com/client/local"
+	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/tsnet"
+	"tailscale.com/types/nettype"
+	"tailscale.com/wgengine/netstack"
 )
 
 var (
-	tsHostname  = flag.String("tailscale-hostname", "tsv", "Tailscale hostname")
-	tsConfigDir = flag.String("tailscale-config-dir", "", "Directory to store tsnet state")
+	tsHostname         = flag.String("tailscale-hostname", "tsv", "Tailscale hostname")
+	tsConfigDir        = flag.String("tailscale-config-dir", "", "Directory to store tsnet state")
+	tsTags             = flag.String("tailscale-tags", "", "Tailscale tags to advertise (comma-separated, e.g. tag:vpn)")
+	tsEphemeral        = flag.Bool("tailscale-ephemeral", false, "Register as an ephemeral node, which logs out when stopped and is removed from the tailnet soon after going offline")
+	tsPreauthorized    = flag.Bool("tailscale-preauthorized", false, "Mark auth keys minted with the OAuth client secret as pre-authorised, so the node skips device approval")
+	tsControlURL       = flag.String("tailscale-control-url", "", "URL of the coordination server to use, e.g. for Headscale (defaults to Tailscale's)")
+	tsAllowBogonRoutes = flag.Bool("tailscale-allow-bogon-routes", false, "Allow advertising extra routes in private and reserved ranges such as 10.0.0.0/8 and 127.0.0.0/8")
+	tsExitNode         = flag.Bool("tailscale-exit-node", true, "Advertise the default routes so the node can be used as an exit node (if false, only --tailscale-extra-routes are advertised, as a subnet router)")
+	tsExtraRoutes      = listFlag("tailscale-extra-routes", "", "Subnet routes to advertise in addition to the exit node routes (comma-separated IPs or CIDR prefixes, may be repeated; e.g. 8.8.8.0/24)")
+
+	tsWaitForHealthy    = flag.Bool("tailscale-wait-for-healthy", false, "Don't advertise routes until the WireGuard health check has passed")
+	tsWithdrawUnhealthy = flag.Bool("tailscale-withdraw-unhealthy", false, "Stop advertising routes while the WireGuard health check is failing")
+	tsKeepaliveIdle     = flag.Duration("tailscale-keepalive-idle", time.Minute, "Idle time before sending TCP keepalives to tailnet clients (0 for the netstack default of ~2h)")
+	tsKeepaliveInterval = flag.Duration("tailscale-keepalive-interval", 15*time.Second, "Interval between TCP keepalives to tailnet clients (0 for the netstack default of 75s)")
+	tsOAuthClientSecret = flag.String("tailscale-oauth-client-secret", "", "Tailscale OAuth client secret used to mint auth keys (requires --tailscale-tags)")
+	tsAuthKey           = flag.String("tailscale-auth-key", "", "Tailscale auth key used to register the node (defaults to TS_AUTHKEY)")
+
+	tsAuthKeyFile           = flag.String("tailscale-auth-key-file", "", "Path to a file containing the Tailscale auth key (alternative to --tailscale-auth-key)")
+	tsOAuthClientSecretFile = flag.String("tailscale-oauth-client-secret-file", "", "Path to a file containing the Tailscale OAuth client secret (alternative to --tailscale-oauth-client-secret)")
 )
 
-func ConnectToTailscale(ctx context.Context, connectionHandler func(net.Conn, netip.AddrPort, netip.AddrPort)) (*tsnet.Server, error) {
+// ConnectToTailscale starts the Tailscale node and advertises its routes,
+// returning the RouteAdvertiser that controls them. UDP flows are passed to
+// udpHandler if it is non-nil. If health is non-nil, it can be used to hold
+// back routes while the upstream is unhealthy.
+func ConnectToTailscale(ctx context.Context, hostname string, flowHandler tsnet.FallbackTCPHandler, udpHandler UDPFlowHandler, health HealthMonitor) (*tsnet.Server, *RouteAdvertiser, error) {
+	// Netstack enables keepalives on forwarded connections, but with timers
+	// so long that connections from devices that sleep or roam away linger
+	// until the idle timeout. These knobs are read for each new connection.
+	if *tsKeepaliveIdle > 0 {
+		envknob.Setenv("TS_NETSTACK_KEEPALIVE_IDLE", tsKeepaliveIdle.String())
+	}
+	if *tsKeepaliveInterval > 0 {
+		envknob.Setenv("TS_NETSTACK_KEEPALIVE_INTERVAL", tsKeepaliveInterval.String())
+	}
+
+	ephemeral, preauthorized := authKeyOptions()
 	server := &tsnet.Server{
-		Hostname: *tsHostname,
-		Dir:      *tsConfigDir,
+		Hostname:      hostname,
+		Dir:           *tsConfigDir,
+		ControlURL:    *tsControlURL,
+		AdvertiseTags: parseTags(*tsTags),
+		AuthKey:       *tsAuthKey,
+		ClientSecret:  oauthClientSecret(*tsOAuthClientSecret, ephemeral, preauthorized),
+		Ephemeral:     *tsEphemeral,
 		UserLogf: func(format string, args ...any) {
 			slog.Info(fmt.Sprintf(format, args...))
 		},
@@ -29,43 +76,312 @@ func ConnectToTailscale(ctx context.Context, connectionHandler func(net.Conn, ne
 		},
 	}
 
-	server.RegisterFallbackTCPHandler(func(src, dst netip.AddrPort) (func(net.Conn), bool) {
-		return func(conn net.Conn) {
-			connectionHandler(conn, src, dst)
-		}, true
-	})
+	if *tsEncryptState {
+		store, err := newEncryptedStateStore(*tsConfigDir, *statePassphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open encrypted state: %w", err)
+		}
+		server.Store = store
+	}
+
+	server.RegisterFallbackTCPHandler(flowHandler)
+
+	slog.Info("Starting Tailscale node", "hostname", hostname)
 
-	slog.Info("Starting Tailscale node", "hostname", *tsHostname)
+	if err := server.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	if udpHandler != nil {
+		if err := registerUDPHandler(server, udpHandler); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	_, err := server.Up(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	slog.Info("Tailscale node is up, advertising as AppConnector")
 
+	registerNetstackMetrics(server)
+	tailscaleUserMetrics.Store(server.Sys().UserMetricsRegistry())
+
 	lc, err := server.LocalClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get LocalClient: %w", err)
-	}
-
-	_, err = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
-		Prefs: ipn.Prefs{
-			AppConnector: ipn.AppConnectorPrefs{
-				Advertise: true,
-			},
-			AdvertiseRoutes: []netip.Prefix{
-				netip.MustParsePrefix("0.0.0.0/0"),
-				netip.MustParsePrefix("::/0"),
-			},
-		},
-		AppConnectorSet:    true,
-		AdvertiseRoutesSet: true,
-	})
+		return nil, nil, fmt.Errorf("failed to get LocalClient: %w", err)
+	}
+
+	excluded, err := parsePrefixSet(excludeIPs.String())
 	if err != nil {
-		return nil, fmt.Errorf("failed to advertise as AppConnector: %w", err)
+		return nil, nil, fmt.Errorf("invalid excluded IPs: %w", err)
+	}
+	if !*tsAllowBogonRoutes {
+		excluded = append(excluded, bogonRoutes...)
+	}
+
+	routes, err := advertisedRoutes(tsExtraRoutes.String(), excluded, *tsExitNode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *tsRoutesFile != "" {
+		saved, err := loadRoutes(*tsRoutesFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load saved routes: %w", err)
+		}
+		if saved != nil {
+			routes = validSavedRoutes(saved, excluded)
+			slog.Info("Using saved routes instead of the configured routes", "routes", routes)
+		}
+	}
+
+	var conflicts []routeConflict
+	if status, err := lc.Status(ctx); err != nil {
+		slog.Warn("Failed to check for route conflicts", "error", err)
+	} else {
+		conflicts = routeConflicts(routes, status)
+		for _, conflict := range conflicts {
+			warnRouteConflict(conflict, *tsSkipConflictingRoutes)
+		}
+	}
+
+	advertiser := &RouteAdvertiser{
+		lc:          lc,
+		excluded:    excluded,
+		saveTo:      *tsRoutesFile,
+		debounce:    *tsRouteDebounce,
+		historySize: *tsRouteHistory,
+		webhook:     *tsRoutesWebhook,
+		routes:      routes,
+		withheld:    make(map[string]bool),
+	}
+	if *tsSkipConflictingRoutes {
+		advertiser.conflicting = conflictingRoutes(conflicts)
+	}
+	if *standbyFor != "" {
+		advertiser.withheld["standby"] = true
+		slog.Info("Standing by, routes won't be advertised while the active node is online", "active", *standbyFor)
+	}
+
+	if health != nil && (*tsWaitForHealthy || *tsWithdrawUnhealthy) {
+		// The listener is only told about changes, so it has to be in place
+		// before the current health is checked or a change in between would
+		// be missed. Checking under the advertiser's lock means any change
+		// after the check is applied after it, too.
+		health.SetHealthListener(advertiser.healthChanged)
+	}
+	if health != nil && *tsWaitForHealthy {
+		advertiser.mutex.Lock()
+		if !health.Healthy() {
+			advertiser.withheld["unhealthy"] = true
+			slog.Info("Waiting for the upstream to become healthy before advertising routes")
+		}
+		advertiser.mutex.Unlock()
+	}
+
+	if err := advertiser.Apply(ctx, "startup"); err != nil {
+		return nil, nil, fmt.Errorf("failed to advertise as AppConnector: %w", err)
 	}
 
 	slog.Info("Successfully advertised as AppConnector")
-	return server, nil
+
+	go MonitorKeyExpiry(ctx, lc)
+	login := &loginWatcher{lc: lc}
+	go WatchIPNBus(ctx, lc, func(n ipn.Notify) {
+		login.handle(ctx, n)
+		advertiser.handle(ctx, n)
+	})
+	go MonitorRouteApproval(ctx, lc)
+	go MonitorRouteConflicts(ctx, advertiser)
+	if *standbyFor != "" {
+		go MonitorActiveNode(ctx, lc, advertiser)
+	}
+
+	return server, advertiser, nil
+}
+
+// WatchIPNBus passes each notification about the node's state to handle until
+// ctx is cancelled, reconnecting to the bus if needed
+func WatchIPNBus(ctx context.Context, lc *local.Client, handle func(ipn.Notify)) {
+	for {
+		if err := watchIPNBus(ctx, lc, handle); err != nil && ctx.Err() == nil {
+			slog.Warn("Failed to watch Tailscale state", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// watchIPNBus passes notifications to handle until the watcher fails
+func watchIPNBus(ctx context.Context, lc *local.Client, handle func(ipn.Notify)) error {
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		handle(n)
+	}
+}
+
+// registerNetstackMetrics exports the statistics of the tsnet netstack, which
+// include packet drops and TCP forwarder in-flight limits
+func registerNetstackMetrics(server *tsnet.Server) {
+	ns, ok := server.Sys().Netstack.GetOK()
+	if !ok {
+		return
+	}
+
+	if v, ok := ns.(interface{ ExpVar() expvar.Var }); ok {
+		if vars, ok := v.ExpVar().(interface{ Do(func(expvar.KeyValue)) }); ok {
+			prometheus.MustRegister(&expvarCollector{prefix: "tsv_tailscale_netstack_", vars: vars})
+		}
+	}
+}
+
+// registerUDPHandler passes UDP flows that aren't for one of the server's own
+// listeners to handler. tsnet has no equivalent of RegisterFallbackTCPHandler
+// for UDP, so this replaces netstack's UDP flow handler directly; it must be
+// called before the node is up and receiving packets.
+func registerUDPHandler(server *tsnet.Server, handler UDPFlowHandler) error {
+	ns, ok := server.Sys().Netstack.Get().(*netstack.Impl)
+	if !ok {
+		return fmt.Errorf("UDP forwarding isn't supported by this netstack")
+	}
+
+	previous := ns.GetUDPHandlerForFlow
+	ns.GetUDPHandlerForFlow = func(src, dst netip.AddrPort) (func(nettype.ConnPacketConn), bool) {
+		if previous != nil {
+			// Let tsnet handle anything for its own listeners (e.g. MagicDNS)
+			if h, intercept := previous(src, dst); h != nil || !intercept {
+				return h, intercept
+			}
+		}
+		return handler(src, dst)
+	}
+	return nil
+}
+
+// logoutEphemeralNode logs the node out, so that control removes it from the
+// tailnet immediately instead of after the ephemeral node timeout
+func logoutEphemeralNode(lc *local.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := lc.Logout(ctx); err != nil {
+		slog.Warn("Failed to log out ephemeral node", "error", err)
+		return
+	}
+	slog.Info("Logged out ephemeral node")
+}
+
+// advertisedRoutes returns the routes the node should advertise: the default
+// routes that make it an exit node (if exitNode is set), followed by any extra
+// subnet routes that aren't entirely excluded. Extra routes may not overlap the
+// ranges used by Tailscale itself, as that would break connectivity for clients.
+func advertisedRoutes(extra string, excluded prefixSet, exitNode bool) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	if exitNode {
+		routes = append(routes, exitNodeRoutes...)
+	}
+
+	for _, route := range strings.Split(extra, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		prefix, err := parsePrefixOrAddr(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra route %s: %w", route, err)
+		}
+		if slices.Contains(routes, prefix) {
+			continue
+		}
+		if tailscaleRoutes.overlaps(prefix) {
+			return nil, fmt.Errorf("extra route %s overlaps Tailscale's own addresses", prefix)
+		}
+		if excluded.covers(prefix) {
+			slog.Warn("Not advertising excluded or reserved route", "route", prefix)
+			continue
+		}
+		routes = append(routes, prefix)
+	}
+
+	return routes, nil
+}
+
+// parseTags parses a comma-separated list of Tailscale tags
+func parseTags(tags string) []string {
+	var res []string
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			res = append(res, tag)
+		}
+	}
+	return res
+}
+
+// oauthClientSecret adds ephemeral and preauthorized attributes to an OAuth
+// client secret so that minted auth keys create persistent nodes unless
+// ephemeral is set. Tailscale otherwise defaults to ephemeral keys, which
+// would remove the gateway whenever it goes offline. Attributes specified by
+// the user are left untouched.
+func oauthClientSecret(secret string, ephemeral, preauthorized bool) string {
+	if secret == "" {
+		return secret
+	}
+
+	base, attrs, _ := strings.Cut(secret, "?")
+	values, err := url.ParseQuery(attrs)
+	if err != nil {
+		return secret
+	}
+
+	var added []string
+	if !values.Has("ephemeral") {
+		added = append(added, fmt.Sprintf("ephemeral=%t", ephemeral))
+	}
+	if !values.Has("preauthorized") {
+		added = append(added, fmt.Sprintf("preauthorized=%t", preauthorized))
+	}
+	if len(added) == 0 {
+		return secret
+	}
+	if attrs == "" {
+		return base + "?" + strings.Join(added, "&")
+	}
+	return secret + "&" + strings.Join(added, "&")
+}
+
+// authKeyOptions returns whether auth keys minted with the OAuth client
+// secret should be ephemeral and pre-authorised. Attributes on the secret take
+// precedence over the flags, as they do when tsnet mints the key.
+func authKeyOptions() (ephemeral, preauthorized bool) {
+	ephemeral, preauthorized = *tsEphemeral, *tsPreauthorized
+
+	_, attrs, _ := strings.Cut(*tsOAuthClientSecret, "?")
+	values, err := url.ParseQuery(attrs)
+	if err != nil {
+		return ephemeral, preauthorized
+	}
+	if v, err := strconv.ParseBool(values.Get("ephemeral")); err == nil {
+		ephemeral = v
+	}
+	if v, err := strconv.ParseBool(values.Get("preauthorized")); err == nil {
+		preauthorized = v
+	}
+	return ephemeral, preauthorized
 }
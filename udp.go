@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/types/nettype"
+)
+
+var (
+	udpForwarding = flag.Bool("udp", false, "Forward UDP flows from the tailnet as well as TCP connections (not supported by the ssh upstream)")
+	udpTimeout    = flag.Duration("udp-timeout", time.Minute, "How long a UDP flow can go without traffic in either direction before it is closed")
+)
+
+// maxUDPPacketSize is the largest payload a UDP packet can carry
+const maxUDPPacketSize = 65535
+
+// packetBuffers holds buffers big enough for any UDP packet
+var packetBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, maxUDPPacketSize)
+		return &buf
+	},
+}
+
+var udpFlows = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "tsv_udp_flows",
+	Help: "Number of UDP flows currently being forwarded",
+})
+
+// UDPFlowHandler decides whether to handle a UDP flow from the tailnet, in the
+// same way as tsnet.FallbackTCPHandler does for TCP
+type UDPFlowHandler func(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool)
+
+// udpFlow identifies a UDP flow by its source and destination
+type udpFlow struct {
+	src netip.AddrPort
+	dst netip.AddrPort
+}
+
+// udpSessions is a NAT-style table of the UDP flows being forwarded, each
+// with its own upstream socket
+type udpSessions struct {
+	mutex    sync.Mutex
+	sessions map[udpFlow]func()
+	quicIDs  quicConnectionIDs
+}
+
+// add records a new session along with a function that closes it, returning
+// false if the flow is already being forwarded
+func (s *udpSessions) add(flow udpFlow, closer func()) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sessions[flow]; ok {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[udpFlow]func())
+	}
+	s.sessions[flow] = closer
+	udpFlows.Set(float64(len(s.sessions)))
+	return true
+}
+
+// remove forgets a session
+func (s *udpSessions) remove(flow udpFlow) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, flow)
+	udpFlows.Set(float64(len(s.sessions)))
+}
+
+// closeAll closes every session
+func (s *udpSessions) closeAll() {
+	s.mutex.Lock()
+	closers := make([]func(), 0, len(s.sessions))
+	for _, closer := range s.sessions {
+		closers = append(closers, closer)
+	}
+	s.mutex.Unlock()
+
+	for _, closer := range closers {
+		closer()
+	}
+}
+
+// HandleUDPFlow is called for each new UDP flow from the tailnet. Flows are
+// subject to the same checks as TCP connections.
+func (p *Proxy) HandleUDPFlow(src, dst netip.AddrPort) (func(nettype.ConnPacketConn), bool) {
+	srcAddr := src.String()
+	logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
+
+	if p.draining.Load() || p.paused.Load() {
+		slog.Debug("Rejecting UDP flow while draining or paused", "destination", logDest, "source", srcAddr)
+		return nil, true
+	}
+
+	if p.excluded.contains(dst.Addr()) {
+		slog.Debug("Rejecting UDP flow to excluded destination", "destination", logDest, "source", srcAddr)
+		return nil, true
+	}
+
+	// netstack calls this on its packet processing path, so anything that can
+	// block (looking up the source's identity, or queueing for a slot) is left
+	// to the handler, which it always runs once the flow is intercepted
+	return func(clientConn nettype.ConnPacketConn) {
+		if (len(p.allowed) > 0 || len(p.policies) > 0) && !p.sourceAllowed(src, dst) {
+			_ = clientConn.Close()
+			return
+		}
+
+		if !p.limiter.acquire(p.ctx, src.Addr()) {
+			slog.Info("Rejecting UDP flow over the connection limit", "destination", logDest, "source", srcAddr)
+			_ = clientConn.Close()
+			return
+		}
+		defer p.limiter.release(src.Addr())
+
+		p.handleUDPFlow(clientConn, src, dst)
+	}, true
+}
+
+// handleUDPFlow forwards packets between a client's UDP flow and a socket
+// dialled through the upstream, until the flow is idle for the timeout for
+// the protocol it is carrying
+func (p *Proxy) handleUDPFlow(clientConn net.Conn, src, dst netip.AddrPort) {
+	srcAddr := src.String()
+	logDest := redactAddrPort(dst, *logPrivacy, *logPrivacySalt)
+
+	defer clientConn.Close()
+	client := limitPacketConn(p.limitCtx, clientConn, p.uploadLimit, newBandwidthLimiter(p.perConnLimit))
+
+	dialCtx, dialCancel := context.WithTimeout(p.ctx, p.dialTimeouts.lookup(dst.Addr(), *dialTimeout))
+	dialStart := time.Now()
+	serverConn, err := p.dialer.DialContext(dialCtx, "udp", dst.String())
+	dialLatency := time.Since(dialStart)
+	dialCancel()
+	if err != nil {
+		slog.Error("Failed to dial upstream for UDP flow", "destination", logDest, "source", srcAddr, "error", redactError(err, dst, *logPrivacy, *logPrivacySalt))
+		return
+	}
+	defer serverConn.Close()
+	server := limitPacketConn(p.limitCtx, serverConn, p.downloadLimit, newBandwidthLimiter(p.perConnLimit))
+
+	flow := udpFlow{src: src, dst: dst}
+	closeBoth := func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	}
+	if !p.udpSessions.add(flow, closeBoth) {
+		slog.Debug("UDP flow is already being forwarded", "destination", logDest, "source", srcAddr)
+		return
+	}
+	defer p.udpSessions.remove(flow)
+
+	// A new flow always starts with a packet from the client, which tells us
+	// what protocol it is
+	bufp := packetBuffers.Get().(*[]byte)
+	defer packetBuffers.Put(bufp)
+	buf := *bufp
+	_ = client.SetReadDeadline(time.Now().Add(*udpTimeout))
+	n, err := client.Read(buf)
+	if err != nil {
+		return
+	}
+
+	protocol := classifyUDPFlow(dst.Port(), buf[:n], &p.udpSessions.quicIDs)
+	slog.Debug("UDP flow opened", "destination", logDest, "source", srcAddr, "protocol", protocol)
+
+	port := strconv.Itoa(int(dst.Port()))
+	source := metricsSource(src.Addr())
+	start := time.Now()
+
+	proxyDialDuration.WithLabelValues("udp", port).Observe(dialLatency.Seconds())
+	proxyConnections.WithLabelValues("udp", port, source).Inc()
+	sent := &countingWriter{counter: proxyBytes.WithLabelValues("sent", "udp", port, source)}
+	received := &countingWriter{counter: proxyBytes.WithLabelValues("received", "udp", port, source)}
+
+	defer func() {
+		duration := time.Since(start)
+		proxyConnectionDuration.WithLabelValues("udp", port).Observe(duration.Seconds())
+
+		level := slog.LevelDebug
+		if *logConnections {
+			level = slog.LevelInfo
+		}
+		slog.Log(p.ctx, level, "UDP flow closed", "destination", logDest, "source", srcAddr, "duration", duration, "dial_latency", dialLatency, "bytes_sent", sent.total.Load(), "bytes_received", received.total.Load())
+	}()
+
+	var inspect func([]byte)
+	if protocol == udpQUIC {
+		quic := &quicFlow{known: &p.udpSessions.quicIDs, ids: make(map[string]bool)}
+		defer quic.close()
+		inspect = quic.inspect
+		inspect(buf[:n])
+	}
+
+	if _, err := server.Write(buf[:n]); err != nil {
+		return
+	}
+	_, _ = sent.Write(buf[:n])
+
+	relayPackets(client, server, protocol.timeout(), inspect, sent, received)
+}
+
+// relayPackets copies packets in both directions between a and b until
+// neither has sent anything for timeout, or either fails. If inspect is
+// non-nil, it is called with each packet. Packets copied from a to b are also
+// written to sent, and from b to a to received.
+func relayPackets(a, b net.Conn, timeout time.Duration, inspect func([]byte), sent, received io.Writer) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	done := make(chan struct{}, 2)
+	copyPackets := func(dst, src net.Conn, counter io.Writer) {
+		defer func() { done <- struct{}{} }()
+
+		bufp := packetBuffers.Get().(*[]byte)
+		defer packetBuffers.Put(bufp)
+		buf := *bufp
+		for {
+			_ = src.SetReadDeadline(time.Now().Add(timeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				// Keep waiting if the other direction has been active
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, lastActive.Load())) < timeout {
+					continue
+				}
+				return
+			}
+
+			lastActive.Store(time.Now().UnixNano())
+			if inspect != nil {
+				inspect(buf[:n])
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			_, _ = counter.Write(buf[:n])
+		}
+	}
+
+	go copyPackets(b, a, sent)
+	go copyPackets(a, b, received)
+
+	// Once one direction stops, close both so the other does too
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandleUDPFlow(t *testing.T) {
+	mock, err := NewMockDialer()
+	if err != nil {
+		t.Fatalf("NewMockDialer() error = %v", err)
+	}
+	defer mock.Close()
+
+	previous := *udpTimeout
+	*udpTimeout = 200 * time.Millisecond
+	defer func() { *udpTimeout = previous }()
+
+	proxy := &Proxy{dialer: mock, ctx: context.Background()}
+	client, server := net.Pipe()
+	defer client.Close()
+
+	src := netip.MustParseAddrPort("100.64.0.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:9000")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.handleUDPFlow(server, src, dst)
+	}()
+
+	// Keep the flow active for longer than the timeout
+	for range 3 {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		buf := make([]byte, 16)
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Errorf("reply = %q, want %q", buf[:n], "ping")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("flow closed while still active")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("flow wasn't closed after being idle")
+	}
+
+	for _, direction := range []string{"sent", "received"} {
+		if got := testutil.ToFloat64(proxyBytes.WithLabelValues(direction, "udp", "9000", "")); got != 12 {
+			t.Errorf("%s bytes = %v, want 12", direction, got)
+		}
+	}
+	if got := testutil.ToFloat64(proxyConnections.WithLabelValues("udp", "9000", "")); got != 1 {
+		t.Errorf("flows = %v, want 1", got)
+	}
+}
+
+// recordingDialer counts dial attempts, all of which fail
+type recordingDialer struct {
+	dials atomic.Int32
+}
+
+func (d *recordingDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	d.dials.Add(1)
+	return nil, errors.New("no upstream")
+}
+
+func TestHandleUDPFlowConnectionLimit(t *testing.T) {
+	dialer := &recordingDialer{}
+	proxy := &Proxy{
+		dialer:  dialer,
+		ctx:     context.Background(),
+		limiter: &connectionLimiter{max: 1, bySource: make(map[netip.Addr]int), released: make(chan struct{})},
+	}
+	src := netip.MustParseAddrPort("100.64.0.2:40000")
+	dst := netip.MustParseAddrPort("192.0.2.1:9000")
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	_ = client.Close()
+
+	// Another flow holds the only slot. The flow is still intercepted, as
+	// the limit is only checked once the handler runs.
+	proxy.limiter.tryAcquire(netip.MustParseAddr("100.64.0.3"))
+	handler, intercept := proxy.HandleUDPFlow(src, dst)
+	if handler == nil || !intercept {
+		t.Fatalf("HandleUDPFlow() = %v, %v, want a handler", handler != nil, intercept)
+	}
+	handler(client)
+	if n := dialer.dials.Load(); n != 0 {
+		t.Errorf("flow over the connection limit dialled the upstream %d times", n)
+	}
+
+	// Once it's free, the next flow takes the slot and gives it back when done
+	proxy.limiter.release(netip.MustParseAddr("100.64.0.3"))
+	handler, _ = proxy.HandleUDPFlow(src, dst)
+	handler(client)
+	if n := dialer.dials.Load(); n != 1 {
+		t.Errorf("flow under the connection limit dialled the upstream %d times, want 1", n)
+	}
+	if !proxy.limiter.tryAcquire(src.Addr()) {
+		t.Error("finished flow didn't release its slot")
+	}
+}
+
+func TestClassifyUDPFlow(t *testing.T) {
+	// A QUIC v1 Initial with an 8 byte destination ID and 4 byte source ID
+	initial := append([]byte{0xc3, 0x00, 0x00, 0x00, 0x01, 0x08, 1, 2, 3, 4, 5, 6, 7, 8, 0x04, 9, 10, 11, 12}, make([]byte, 32)...)
+
+	known := &quicConnectionIDs{}
+	known.add([]byte{9, 10, 11, 12})
+
+	tests := []struct {
+		name   string
+		port   uint16
+		packet []byte
+		want   udpProtocol
+	}{
+		{"dns", 53, []byte{0x12, 0x34, 0x01, 0x00}, udpDNS},
+		{"quic initial", 443, initial, udpQUIC},
+		{"quic initial on another port", 8443, initial, udpQUIC},
+		{"known short header", 443, []byte{0x41, 9, 10, 11, 12, 0xff, 0xff}, udpQUIC},
+		{"unknown short header", 443, []byte{0x41, 1, 2, 3, 4, 0xff, 0xff}, udpGeneric},
+		{"version negotiation", 443, []byte{0xc0, 0, 0, 0, 0, 0x01, 1, 0x01, 2}, udpGeneric},
+		{"truncated long header", 443, initial[:10], udpGeneric},
+		{"other", 9000, []byte("hello"), udpGeneric},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyUDPFlow(tt.port, tt.packet, known); got != tt.want {
+				t.Errorf("classifyUDPFlow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQUICFlowTracksConnectionIDs(t *testing.T) {
+	known := &quicConnectionIDs{}
+	flow := &quicFlow{known: known, ids: make(map[string]bool)}
+
+	// Server's reply to an Initial, choosing its own connection ID
+	flow.inspect([]byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x04, 9, 10, 11, 12, 0x04, 21, 22, 23, 24})
+	flow.inspect([]byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x04, 9, 10, 11, 12, 0x04, 21, 22, 23, 24})
+
+	shortHeader := []byte{0x40, 21, 22, 23, 24, 0xff}
+	if !known.matchesShortHeader(shortHeader) {
+		t.Errorf("short header for the server's connection ID wasn't recognised")
+	}
+
+	flow.close()
+	if known.matchesShortHeader(shortHeader) {
+		t.Errorf("connection ID still tracked after the flow closed")
+	}
+}
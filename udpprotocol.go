@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	udpDNSTimeout  = flag.Duration("udp-dns-timeout", 10*time.Second, "How long a UDP flow to port 53 can be idle before it is closed")
+	udpQUICTimeout = flag.Duration("udp-quic-timeout", 5*time.Minute, "How long a QUIC flow can be idle before it is closed")
+)
+
+// udpProtocol is the protocol a UDP flow appears to be carrying, which
+// determines how long it can be idle
+type udpProtocol int
+
+const (
+	udpGeneric udpProtocol = iota
+	udpDNS
+	udpQUIC
+)
+
+func (p udpProtocol) String() string {
+	switch p {
+	case udpDNS:
+		return "dns"
+	case udpQUIC:
+		return "quic"
+	default:
+		return "generic"
+	}
+}
+
+// timeout returns how long flows of this protocol can be idle
+func (p udpProtocol) timeout() time.Duration {
+	switch p {
+	case udpDNS:
+		return *udpDNSTimeout
+	case udpQUIC:
+		return *udpQUICTimeout
+	default:
+		return *udpTimeout
+	}
+}
+
+// quicConnectionIDs tracks the connection IDs of QUIC flows being forwarded,
+// so that a flow continuing a QUIC connection from a new address (e.g. after
+// the client roams or its NAT rebinds) is recognised even though it only
+// carries short header packets
+type quicConnectionIDs struct {
+	mutex sync.Mutex
+	ids   map[string]int
+}
+
+// add starts tracking a connection ID. IDs are counted, so must be removed
+// as many times as they are added.
+func (q *quicConnectionIDs) add(id []byte) {
+	if len(id) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.ids == nil {
+		q.ids = make(map[string]int)
+	}
+	q.ids[string(id)]++
+}
+
+// remove stops tracking a connection ID
+func (q *quicConnectionIDs) remove(id []byte) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.ids[string(id)] <= 1 {
+		delete(q.ids, string(id))
+	} else {
+		q.ids[string(id)]--
+	}
+}
+
+// matchesShortHeader returns whether packet is a QUIC short header packet
+// for one of the tracked connections. Short headers don't include the length
+// of the connection ID, so each tracked ID is compared in turn.
+func (q *quicConnectionIDs) matchesShortHeader(packet []byte) bool {
+	if len(packet) < 2 || packet[0]&0xc0 != 0x40 {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for id := range q.ids {
+		if bytes.HasPrefix(packet[1:], []byte(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyUDPFlow works out which protocol a flow to dst is carrying from its
+// first packet
+func classifyUDPFlow(dst uint16, packet []byte, known *quicConnectionIDs) udpProtocol {
+	switch {
+	case dst == 53:
+		return udpDNS
+	case isQUICLongHeader(packet), known.matchesShortHeader(packet):
+		return udpQUIC
+	default:
+		return udpGeneric
+	}
+}
+
+// isQUICLongHeader returns whether packet looks like a QUIC long header packet
+// (as sent during the handshake)
+func isQUICLongHeader(packet []byte) bool {
+	_, _, ok := parseQUICLongHeader(packet)
+	return ok
+}
+
+// parseQUICLongHeader returns the destination and source connection IDs from
+// a QUIC long header packet (RFC 9000 section 17.2)
+func parseQUICLongHeader(packet []byte) (dcid, scid []byte, ok bool) {
+	// Header form and fixed bits, version, and destination connection ID length
+	if len(packet) < 6 || packet[0]&0xc0 != 0xc0 || binary.BigEndian.Uint32(packet[1:5]) == 0 {
+		return nil, nil, false
+	}
+
+	rest := packet[5:]
+	dcid, rest, ok = readConnectionID(rest)
+	if !ok {
+		return nil, nil, false
+	}
+	scid, _, ok = readConnectionID(rest)
+	if !ok {
+		return nil, nil, false
+	}
+	return dcid, scid, true
+}
+
+// readConnectionID reads a length-prefixed connection ID of up to 20 bytes
+func readConnectionID(b []byte) (id, rest []byte, ok bool) {
+	if len(b) < 1 || b[0] > 20 || len(b) < 1+int(b[0]) {
+		return nil, nil, false
+	}
+	return b[1 : 1+b[0]], b[1+b[0]:], true
+}
+
+// quicFlow records the connection IDs seen on a single QUIC flow, so they can
+// be forgotten when it closes
+type quicFlow struct {
+	known *quicConnectionIDs
+
+	mutex sync.Mutex
+	ids   map[string]bool
+}
+
+// inspect tracks any connection IDs in a long header packet sent in either
+// direction
+func (f *quicFlow) inspect(packet []byte) {
+	dcid, scid, ok := parseQUICLongHeader(packet)
+	if !ok {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range [][]byte{dcid, scid} {
+		if len(id) > 0 && !f.ids[string(id)] {
+			f.ids[string(id)] = true
+			f.known.add(id)
+		}
+	}
+}
+
+// close forgets the flow's connection IDs
+func (f *quicFlow) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for id := range f.ids {
+		f.known.remove([]byte(id))
+	}
+	f.ids = nil
+}
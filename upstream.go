@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	upstream = flag.String("upstream", "wireguard", "Upstream to send proxied traffic to ('wireguard', 'ssh' or 'mock')")
+)
+
+// Dialer creates connections to the upstream that proxied traffic is sent over
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// MockDialer is a Dialer that connects to a local echo server instead of a real
+// upstream, so the tailnet side of the proxy can be tested without a VPN
+type MockDialer struct {
+	listener     net.Listener
+	packetConn   net.PacketConn
+	destinations sync.Map
+}
+
+// NewMockDialer creates a new mock dialer and starts its echo servers
+func NewMockDialer() (*MockDialer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mock upstream: %w", err)
+	}
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to start mock UDP upstream: %w", err)
+	}
+
+	m := &MockDialer{listener: listener, packetConn: packetConn}
+	go m.serve()
+	go m.servePackets()
+	return m, nil
+}
+
+// DialContext connects to the echo server, remembering the requested address
+// so it can be included in responses. UDP packets are echoed back verbatim.
+func (m *MockDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	if strings.HasPrefix(network, "udp") {
+		return d.DialContext(ctx, "udp", m.packetConn.LocalAddr().String())
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", m.listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	m.destinations.Store(conn.LocalAddr().String(), address)
+	return conn, nil
+}
+
+// Close stops the echo servers
+func (m *MockDialer) Close() error {
+	return errors.Join(m.listener.Close(), m.packetConn.Close())
+}
+
+func (m *MockDialer) servePackets() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := m.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = m.packetConn.WriteTo(buf[:n], addr)
+	}
+}
+
+func (m *MockDialer) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		destination, _ := m.destinations.LoadAndDelete(conn.RemoteAddr().String())
+		go m.handle(conn, fmt.Sprint(destination))
+	}
+}
+
+// handle responds to HTTP requests with a plain-text description of the
+// request, and echoes anything else back verbatim
+func (m *MockDialer) handle(conn net.Conn, destination string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	if !strings.Contains(line, " HTTP/1.") {
+		slog.Debug("Mock upstream echoing", "destination", destination)
+		if _, err := io.WriteString(conn, line); err == nil {
+			_, _ = io.Copy(conn, reader)
+		}
+		return
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader(line), reader)))
+	if err != nil {
+		slog.Debug("Mock upstream received invalid HTTP request", "destination", destination, "error", err)
+		return
+	}
+
+	slog.Debug("Mock upstream responding to HTTP request", "destination", destination, "method", req.Method, "host", req.Host)
+
+	body := fmt.Sprintf("tsv mock upstream\nDestination: %s\nRequest: %s %s %s\nHost: %s\n", destination, req.Method, req.RequestURI, req.Proto, req.Host)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	_ = resp.Write(conn)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMockDialer(t *testing.T) {
+	mock, err := NewMockDialer()
+	if err != nil {
+		t.Fatalf("NewMockDialer() error = %v", err)
+	}
+	defer mock.Close()
+
+	t.Run("echoes raw data", func(t *testing.T) {
+		conn, err := mock.DialContext(context.Background(), "tcp", "192.0.2.1:1234")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+
+		if _, err := io.WriteString(conn, "hello\nworld"); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		_ = conn.(*net.TCPConn).CloseWrite()
+
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		if string(got) != "hello\nworld" {
+			t.Errorf("echo = %q, want %q", got, "hello\nworld")
+		}
+	})
+
+	t.Run("echoes UDP packets", func(t *testing.T) {
+		conn, err := mock.DialContext(context.Background(), "udp", "192.0.2.1:53")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+
+		if _, err := io.WriteString(conn, "ping"); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Errorf("echo = %q, want %q", buf[:n], "ping")
+		}
+	})
+
+	t.Run("responds to HTTP requests", func(t *testing.T) {
+		conn, err := mock.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+
+		if _, err := io.WriteString(conn, "GET /foo HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse() error = %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		for _, want := range []string{"Destination: 192.0.2.1:80", "Request: GET /foo HTTP/1.1", "Host: example.com"} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("response missing %q:\n%s", want, body)
+			}
+		}
+	})
+}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
@@ -22,8 +29,10 @@ var (
 	wgPrivateKey        = flag.String("wg-private-key", "", "WireGuard private key (base64 encoded string)")
 	wgPublicKey         = flag.String("wg-public-key", "", "WireGuard peer public key (base64 encoded string)")
 	wgPresharedKey      = flag.String("wg-preshared-key", "", "WireGuard preshared key (optional; base64 encoded string)")
-	wgEndpoint          = flag.String("wg-endpoint", "", "WireGuard endpoint (host:port; dns names resolved at startup)")
-	wgAllowedIPs        = flag.String("wg-allowed-ips", "0.0.0.0/0,::/0", "WireGuard allowed IPs (comma-separated)")
+	wgPrivateKeyFile    = flag.String("wg-private-key-file", "", "Path to a file containing the WireGuard private key (alternative to --wg-private-key)")
+	wgPresharedKeyFile  = flag.String("wg-preshared-key-file", "", "Path to a file containing the WireGuard preshared key (alternative to --wg-preshared-key)")
+	wgEndpoint          = flag.String("wg-endpoint", "", "WireGuard endpoint (host:port, or a hostname or srv:name to look up an SRV record; dns names resolved at startup)")
+	wgAllowedIPs        = listFlag("wg-allowed-ips", "0.0.0.0/0,::/0", "WireGuard allowed IPs (comma-separated, may be repeated)")
 	wgAddress           = flag.String("wg-address", "", "WireGuard interface address (e.g., 10.0.0.2/32)")
 	wgDNS               = flag.String("wg-dns", "9.9.9.9", "DNS servers (comma-separated)")
 	wgMTU               = flag.Int("wg-mtu", 1420, "WireGuard MTU")
@@ -31,6 +40,10 @@ var (
 	wgHealthCheckPeriod = flag.Duration("wg-health-check-period", 30*time.Second, "Health check period")
 )
 
+// unhealthyThreshold is the number of consecutive failed health checks after
+// which the tunnel is considered unhealthy and restarted
+const unhealthyThreshold = 3
+
 // WireGuardClient manages a userland WireGuard connection
 type WireGuardClient struct {
 	dev                 *device.Device
@@ -39,25 +52,39 @@ type WireGuardClient struct {
 	cancel              context.CancelFunc
 	healthCheckURL      string
 	healthCheckPeriod   time.Duration
-	failureCount        int
-	consecutiveFailures int
+	failureCount        atomic.Int64
+	consecutiveFailures atomic.Int64
+	lastHealthCheck     atomic.Pointer[time.Time]
+	healthy             atomic.Bool
+	healthListener      atomic.Pointer[func(healthy bool)]
+
+	// restartMutex stops restarts requested through the control socket or
+	// admin API from interleaving with those made by the health check
+	restartMutex sync.Mutex
+
+	configMutex sync.Mutex
+	config      *WireGuardConfig
+	// configuredPeer is the peer as it was last loaded from the flags or
+	// config file, which rotation may have since moved away from
+	configuredPeer PeerSettings
 }
 
 // NewWireGuardClient creates a new userland WireGuard client
 func NewWireGuardClient() (*WireGuardClient, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	cfg := &WireGuardConfig{
-		PrivateKey:        *wgPrivateKey,
-		PeerPublicKey:     *wgPublicKey,
-		PresharedKey:      *wgPresharedKey,
-		Endpoint:          *wgEndpoint,
-		AllowedIPs:        *wgAllowedIPs,
-		Address:           *wgAddress,
-		DNSServers:        *wgDNS,
-		MTU:               *wgMTU,
-		HealthCheckURL:    *wgHealthCheckURL,
-		HealthCheckPeriod: *wgHealthCheckPeriod,
+	cfg := wireGuardConfigFromFlags()
+	if *wgProvider != "" {
+		if err := configureFromProvider(ctx, cfg); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	rotationServers, err := parseRotationServers(*wgRotationServers, cfg.PeerPublicKey, cfg.PresharedKey)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
 	dev, tnet, err := cfg.createNetTUN()
@@ -82,10 +109,16 @@ func NewWireGuardClient() (*WireGuardClient, error) {
 		cancel:            cancel,
 		healthCheckURL:    healthCheckURL,
 		healthCheckPeriod: healthCheckPeriod,
+		config:            cfg,
+		configuredPeer:    cfg.peerSettings(),
 	}
 
 	go wgClient.healthCheck()
 
+	if *wgRotationPeriod > 0 && len(rotationServers) > 0 {
+		go wgClient.rotateServers(rotationServers, *wgRotationPeriod)
+	}
+
 	return wgClient, nil
 }
 
@@ -104,44 +137,213 @@ func (wg *WireGuardClient) healthCheck() {
 	ticker := time.NewTicker(wg.healthCheckPeriod)
 	defer ticker.Stop()
 
-	if !wg.checkConnectivity() {
-		wg.consecutiveFailures++
-		wg.failureCount++
-	} else {
-		wg.consecutiveFailures = 0
-	}
+	wg.recordHealthCheck(wg.checkConnectivity())
 
 	for {
 		select {
 		case <-wg.ctx.Done():
 			return
 		case <-ticker.C:
-			if !wg.checkConnectivity() {
-				wg.consecutiveFailures++
-				wg.failureCount++
-
-				if wg.consecutiveFailures >= 3 {
-					slog.Error("WireGuard health check failed 3 consecutive times, attempting to restart device",
-						"total_failures", wg.failureCount,
-						"consecutive_failures", wg.consecutiveFailures)
-					wg.restartDevice()
-				}
-			} else {
-				wg.consecutiveFailures = 0
+			wg.recordHealthCheck(wg.checkConnectivity())
+
+			if wg.consecutiveFailures.Load() >= unhealthyThreshold {
+				slog.Error("WireGuard health check failed repeatedly, attempting to restart device",
+					"total_failures", wg.failureCount.Load(),
+					"consecutive_failures", wg.consecutiveFailures.Load())
+				wg.restartDevice()
 			}
 		}
 	}
 }
 
+// recordHealthCheck updates the failure counters after a health check, and
+// notifies the health listener if the tunnel's health has changed
+func (wg *WireGuardClient) recordHealthCheck(ok bool) {
+	now := time.Now()
+	wg.lastHealthCheck.Store(&now)
+
+	wasHealthy := wg.healthy.Load()
+	if ok {
+		wg.consecutiveFailures.Store(0)
+		wg.healthy.Store(true)
+	} else {
+		wg.failureCount.Add(1)
+		if wg.consecutiveFailures.Add(1) >= unhealthyThreshold {
+			wg.healthy.Store(false)
+		}
+	}
+
+	if listener := wg.healthListener.Load(); listener != nil && wg.healthy.Load() != wasHealthy {
+		(*listener)(wg.healthy.Load())
+	}
+}
+
+// Healthy returns whether the tunnel has passed a health check, and hasn't
+// since failed unhealthyThreshold checks in a row
+func (wg *WireGuardClient) Healthy() bool {
+	return wg.healthy.Load()
+}
+
+// SetHealthListener sets a function to call whenever the tunnel becomes
+// healthy or unhealthy
+func (wg *WireGuardClient) SetHealthListener(listener func(healthy bool)) {
+	wg.healthListener.Store(&listener)
+}
+
+// WireGuardStatus describes the current state of the WireGuard tunnel
+type WireGuardStatus struct {
+	Endpoint            string    `json:"endpoint"`
+	LastHandshake       time.Time `json:"last_handshake,omitzero"`
+	LastHealthCheck     time.Time `json:"last_health_check,omitzero"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int64     `json:"consecutive_failures"`
+	TotalFailures       int64     `json:"total_failures"`
+	ReceivedBytes       int64     `json:"received_bytes"`
+	SentBytes           int64     `json:"sent_bytes"`
+}
+
+// Status returns the current state of the tunnel
+func (wg *WireGuardClient) Status() (WireGuardStatus, error) {
+	status := WireGuardStatus{
+		Endpoint:            wg.PeerSettings().Endpoint,
+		ConsecutiveFailures: wg.consecutiveFailures.Load(),
+		TotalFailures:       wg.failureCount.Load(),
+	}
+	if last := wg.lastHealthCheck.Load(); last != nil {
+		status.LastHealthCheck = *last
+		status.Healthy = wg.healthy.Load()
+	}
+
+	config, err := wg.dev.IpcGet()
+	if err != nil {
+		return status, fmt.Errorf("failed to get device state: %w", err)
+	}
+
+	var handshakeSec, handshakeNsec int64
+	for _, line := range strings.Split(config, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch key {
+		case "last_handshake_time_sec":
+			handshakeSec = n
+		case "last_handshake_time_nsec":
+			handshakeNsec = n
+		case "rx_bytes":
+			status.ReceivedBytes += n
+		case "tx_bytes":
+			status.SentBytes += n
+		}
+	}
+	if handshakeSec > 0 {
+		status.LastHandshake = time.Unix(handshakeSec, handshakeNsec)
+	}
+
+	return status, nil
+}
+
+// PeerSettings are the parts of the WireGuard configuration that can be
+// changed without recreating the device
+type PeerSettings struct {
+	PublicKey    string
+	PresharedKey string
+	Endpoint     string
+	AllowedIPs   string
+}
+
+// PeerSettings returns the current peer configuration of the tunnel
+func (wg *WireGuardClient) PeerSettings() PeerSettings {
+	wg.configMutex.Lock()
+	defer wg.configMutex.Unlock()
+
+	return wg.config.peerSettings()
+}
+
+// peerSettings returns the peer part of the configuration
+func (cfg *WireGuardConfig) peerSettings() PeerSettings {
+	return PeerSettings{
+		PublicKey:    cfg.PeerPublicKey,
+		PresharedKey: cfg.PresharedKey,
+		Endpoint:     cfg.Endpoint,
+		AllowedIPs:   cfg.AllowedIPs,
+	}
+}
+
+// ReloadPeer switches the tunnel to peer if it differs from the peer last
+// loaded from the configuration, returning whether it did. A peer that
+// rotation has moved away from is left alone if the configuration is the same.
+func (wg *WireGuardClient) ReloadPeer(peer PeerSettings) (bool, error) {
+	wg.configMutex.Lock()
+	unchanged := peer == wg.configuredPeer
+	wg.configMutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	if err := wg.UpdatePeer(peer); err != nil {
+		return false, err
+	}
+
+	wg.configMutex.Lock()
+	wg.configuredPeer = peer
+	wg.configMutex.Unlock()
+	return true, nil
+}
+
+// UpdatePeer switches the tunnel to a different peer without recreating the
+// device, so the tunnel's netstack and interface addresses are preserved
+func (wg *WireGuardClient) UpdatePeer(peer PeerSettings) error {
+	wg.configMutex.Lock()
+	defer wg.configMutex.Unlock()
+
+	cfg := *wg.config
+	cfg.PeerPublicKey = peer.PublicKey
+	cfg.PresharedKey = peer.PresharedKey
+	cfg.Endpoint = peer.Endpoint
+	cfg.AllowedIPs = peer.AllowedIPs
+
+	peerConfig, err := cfg.buildPeerConfig()
+	if err != nil {
+		return err
+	}
+
+	// If the peer is unchanged its endpoint and allowed IPs can be updated in
+	// place, keeping the current session. Otherwise the old peer needs to be
+	// removed (which is also the only way to clear a preshared key).
+	if cfg.PeerPublicKey != wg.config.PeerPublicKey || cfg.PresharedKey != wg.config.PresharedKey {
+		peerConfig = "replace_peers=true\n" + peerConfig
+	}
+
+	if err := wg.dev.IpcSet(peerConfig); err != nil {
+		return fmt.Errorf("failed to update peer: %w", err)
+	}
+
+	wg.config = &cfg
+	return nil
+}
+
+// ResolveEndpoint resolves the endpoint again, switching the tunnel to the
+// new address if it has changed
+func (wg *WireGuardClient) ResolveEndpoint() error {
+	return wg.UpdatePeer(wg.PeerSettings())
+}
+
+// Restart restarts the WireGuard device
+func (wg *WireGuardClient) Restart() {
+	wg.restartDevice()
+}
+
 // restartDevice attempts to restart the WireGuard device
 func (wg *WireGuardClient) restartDevice() {
+	wg.restartMutex.Lock()
+	defer wg.restartMutex.Unlock()
+
 	slog.Info("Restarting WireGuard device...")
 
 	wg.dev.Down()
 	time.Sleep(1 * time.Second)
 	wg.dev.Up()
 
-	wg.consecutiveFailures = 0
+	wg.consecutiveFailures.Store(0)
 
 	slog.Info("WireGuard device restarted")
 }
@@ -204,6 +406,90 @@ type WireGuardConfig struct {
 	HealthCheckPeriod time.Duration
 }
 
+// GenerateWireGuardKey creates a new WireGuard private key, returning it and
+// the corresponding public key in base64
+func GenerateWireGuardKey() (privateKey, publicKey string, err error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	// Clamp the key in the same way as `wg genkey`
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	priv, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(priv.Bytes()), base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+// wireGuardPublicKey derives the base64 public key for a base64 private key
+func wireGuardPublicKey(privateKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+
+	priv, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+// wireGuardConfigFromFlags creates a WireGuardConfig from the command line flags
+func wireGuardConfigFromFlags() *WireGuardConfig {
+	return &WireGuardConfig{
+		PrivateKey:        *wgPrivateKey,
+		PeerPublicKey:     *wgPublicKey,
+		PresharedKey:      *wgPresharedKey,
+		Endpoint:          *wgEndpoint,
+		AllowedIPs:        wgAllowedIPs.String(),
+		Address:           *wgAddress,
+		DNSServers:        *wgDNS,
+		MTU:               *wgMTU,
+		HealthCheckURL:    *wgHealthCheckURL,
+		HealthCheckPeriod: *wgHealthCheckPeriod,
+	}
+}
+
+// validate checks every part of the configuration that is parsed when the
+// device is created, including resolving the endpoint, and reports all
+// problems found
+func (cfg *WireGuardConfig) validate() error {
+	var errs []error
+	if _, err := cfg.buildConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.parseInterfaceAddresses(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.parseDNSServers(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, ip := range strings.Split(cfg.AllowedIPs, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(ip); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allowed IP %s: %w", ip, err))
+		}
+	}
+	if cfg.MTU < 576 || cfg.MTU > 65535 {
+		errs = append(errs, fmt.Errorf("invalid MTU %d", cfg.MTU))
+	}
+	if cfg.HealthCheckURL != "" {
+		if u, err := url.Parse(cfg.HealthCheckURL); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid health check URL %s", cfg.HealthCheckURL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // parseInterfaceAddresses parses comma-separated interface addresses
 func (cfg *WireGuardConfig) parseInterfaceAddresses() ([]netip.Addr, error) {
 	address := cfg.Address
@@ -262,13 +548,18 @@ func (cfg *WireGuardConfig) parseDNSServers() ([]netip.Addr, error) {
 
 // resolveEndpoint resolves the endpoint hostname to IP:port
 func (cfg *WireGuardConfig) resolveEndpoint() (string, error) {
-	host, port, err := net.SplitHostPort(cfg.Endpoint)
+	endpoint, err := lookupEndpointSRV(cfg.Endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	host, port, err := net.SplitHostPort(endpoint)
 	if err != nil {
 		return "", fmt.Errorf("invalid endpoint format: %w", err)
 	}
 
 	if ip := net.ParseIP(host); ip != nil {
-		return cfg.Endpoint, nil
+		return endpoint, nil
 	}
 
 	ips, err := net.LookupIP(host)
@@ -296,6 +587,37 @@ func (cfg *WireGuardConfig) resolveEndpoint() (string, error) {
 	return resolvedEndpoint, nil
 }
 
+// lookupSRV is used to look up SRV records, and can be replaced in tests
+var lookupSRV = net.LookupSRV
+
+// lookupEndpointSRV finds the host and port for endpoints given as
+// "srv:<name>", or as a hostname without a port (in which case the
+// _wireguard._udp record for the host is used). Other endpoints are returned
+// unchanged.
+func lookupEndpointSRV(endpoint string) (string, error) {
+	var records []*net.SRV
+	var err error
+	if name, ok := strings.CutPrefix(endpoint, "srv:"); ok {
+		_, records, err = lookupSRV("", "", name)
+	} else if !strings.Contains(endpoint, ":") && net.ParseIP(endpoint) == nil {
+		_, records, err = lookupSRV("wireguard", "udp", endpoint)
+	} else {
+		return endpoint, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to look up SRV record for %s: %w", endpoint, err)
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no SRV records found for %s", endpoint)
+	}
+
+	// Records are sorted by priority and randomised by weight already
+	res := net.JoinHostPort(strings.TrimSuffix(records[0].Target, "."), strconv.Itoa(int(records[0].Port)))
+	slog.Info("Found WireGuard endpoint from SRV record", "name", endpoint, "endpoint", res)
+	return res, nil
+}
+
 // createNetTUN creates a netstack TUN device with parsed addresses
 func (cfg *WireGuardConfig) createNetTUN() (*device.Device, *netstack.Net, error) {
 	ifaceAddrs, err := cfg.parseInterfaceAddresses()
@@ -343,6 +665,16 @@ func (cfg *WireGuardConfig) buildConfig() (string, error) {
 	}
 	privKeyHex := hex.EncodeToString(privKey)
 
+	peerConfig, err := cfg.buildPeerConfig()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("private_key=%s\n%s", privKeyHex, peerConfig), nil
+}
+
+// buildPeerConfig creates the peer section of the WireGuard configuration string
+func (cfg *WireGuardConfig) buildPeerConfig() (string, error) {
 	pubKey, err := base64.StdEncoding.DecodeString(cfg.PeerPublicKey)
 	if err != nil {
 		return "", fmt.Errorf("invalid public key: %w", err)
@@ -371,7 +703,6 @@ func (cfg *WireGuardConfig) buildConfig() (string, error) {
 
 	allowedIPList := strings.Split(cfg.AllowedIPs, ",")
 	var configBuilder strings.Builder
-	configBuilder.WriteString(fmt.Sprintf("private_key=%s\n", privKeyHex))
 	configBuilder.WriteString(fmt.Sprintf("public_key=%s\n", pubKeyHex))
 
 	if pskHex != "" {
@@ -379,6 +710,7 @@ func (cfg *WireGuardConfig) buildConfig() (string, error) {
 	}
 
 	configBuilder.WriteString(fmt.Sprintf("endpoint=%s\n", resolvedEndpoint))
+	configBuilder.WriteString("replace_allowed_ips=true\n")
 
 	for _, ip := range allowedIPList {
 		ip = strings.TrimSpace(ip)
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"net"
 	"net/netip"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -286,3 +291,230 @@ func TestBuildWireGuardConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRotationServers(t *testing.T) {
+	defaultKey := "ZJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo="
+	otherKey := "aJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo="
+	defaultPSK := "bJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo="
+	otherPSK := "cJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo="
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []wireGuardServer
+		wantErr bool
+	}{
+		{
+			name:  "empty string",
+			input: "",
+			want:  nil,
+		},
+		{
+			name:  "endpoints using default key",
+			input: "192.168.1.1:51820, vpn.example.com:51820",
+			want: []wireGuardServer{
+				{PublicKey: defaultKey, PresharedKey: defaultPSK, Endpoint: "192.168.1.1:51820"},
+				{PublicKey: defaultKey, PresharedKey: defaultPSK, Endpoint: "vpn.example.com:51820"},
+			},
+		},
+		{
+			name:  "endpoint with its own key",
+			input: otherKey + "@192.168.1.2:51820",
+			want: []wireGuardServer{
+				{PublicKey: otherKey, Endpoint: "192.168.1.2:51820"},
+			},
+		},
+		{
+			name:  "endpoint with its own key and preshared key",
+			input: otherKey + ":" + otherPSK + "@192.168.1.2:51820",
+			want: []wireGuardServer{
+				{PublicKey: otherKey, PresharedKey: otherPSK, Endpoint: "192.168.1.2:51820"},
+			},
+		},
+		{
+			name:  "endpoint with the default key",
+			input: defaultKey + "@[2001:db8::1]:51820",
+			want: []wireGuardServer{
+				{PublicKey: defaultKey, PresharedKey: defaultPSK, Endpoint: "[2001:db8::1]:51820"},
+			},
+		},
+		{
+			name:    "invalid key",
+			input:   "not-a-key@192.168.1.2:51820",
+			wantErr: true,
+		},
+		{
+			name:    "invalid preshared key",
+			input:   otherKey + ":not-a-key@192.168.1.2:51820",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRotationServers(tt.input, defaultKey, defaultPSK)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRotationServers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseRotationServers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateWireGuardConfig(t *testing.T) {
+	valid := WireGuardConfig{
+		PrivateKey:     "YJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=",
+		PeerPublicKey:  "ZJlw8hY1KE3nQjVhLZVLnY1l3sV4fXTqQJZQJqVLmXo=",
+		Endpoint:       "192.168.1.1:51820",
+		AllowedIPs:     "0.0.0.0/0, ::/0",
+		Address:        "10.0.0.2/32",
+		DNSServers:     "9.9.9.9",
+		MTU:            1420,
+		HealthCheckURL: "https://www.gstatic.com/generate_204",
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(cfg *WireGuardConfig)
+		wantErrs []string
+	}{
+		{
+			name:   "valid",
+			modify: func(cfg *WireGuardConfig) {},
+		},
+		{
+			name: "reports all errors",
+			modify: func(cfg *WireGuardConfig) {
+				cfg.PrivateKey = "short"
+				cfg.AllowedIPs = "0.0.0.0/0,bogus"
+				cfg.Address = "not-an-ip"
+				cfg.DNSServers = "dns.example.com"
+				cfg.MTU = 100
+				cfg.HealthCheckURL = "not a url"
+			},
+			wantErrs: []string{
+				"invalid private key",
+				"invalid allowed IP bogus",
+				"invalid interface address not-an-ip",
+				"invalid DNS server dns.example.com",
+				"invalid MTU 100",
+				"invalid health check URL",
+			},
+		},
+		{
+			name: "invalid endpoint",
+			modify: func(cfg *WireGuardConfig) {
+				cfg.Endpoint = "192.168.1.1"
+			},
+			wantErrs: []string{"invalid endpoint format"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+
+			err := cfg.validate()
+			if len(tt.wantErrs) == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, want := range tt.wantErrs {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateWireGuardKey(t *testing.T) {
+	privateKey, publicKey, err := GenerateWireGuardKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(priv) != 32 {
+		t.Fatalf("private key %q is not a base64 encoded 32 byte key", privateKey)
+	}
+	if priv[0]&7 != 0 || priv[31]&128 != 0 || priv[31]&64 == 0 {
+		t.Errorf("private key %q is not clamped", privateKey)
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()); publicKey != want {
+		t.Errorf("public key = %q, want %q", publicKey, want)
+	}
+}
+
+func TestLookupEndpointSRV(t *testing.T) {
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		switch {
+		case service == "" && proto == "" && name == "_wg._udp.example.com":
+			return "", []*net.SRV{{Target: "vpn1.example.com.", Port: 51821}, {Target: "vpn2.example.com.", Port: 51822}}, nil
+		case service == "wireguard" && proto == "udp" && name == "example.com":
+			return "", []*net.SRV{{Target: "vpn3.example.com.", Port: 51823}}, nil
+		case name == "empty.example.com":
+			return "", nil, nil
+		}
+		return "", nil, errors.New("no such host")
+	}
+	t.Cleanup(func() { lookupSRV = net.LookupSRV })
+
+	tests := []struct {
+		name     string
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{name: "host and port", endpoint: "vpn.example.com:51820", want: "vpn.example.com:51820"},
+		{name: "IPv4 and port", endpoint: "192.168.1.1:51820", want: "192.168.1.1:51820"},
+		{name: "IPv6 and port", endpoint: "[fd00::1]:51820", want: "[fd00::1]:51820"},
+		{name: "IP without port", endpoint: "192.168.1.1", want: "192.168.1.1"},
+		{name: "explicit SRV name", endpoint: "srv:_wg._udp.example.com", want: "vpn1.example.com:51821"},
+		{name: "hostname without port", endpoint: "example.com", want: "vpn3.example.com:51823"},
+		{name: "no records", endpoint: "empty.example.com", wantErr: true},
+		{name: "lookup failure", endpoint: "srv:missing.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupEndpointSRV(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupEndpointSRV() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("lookupEndpointSRV() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthListener(t *testing.T) {
+	wg := &WireGuardClient{}
+
+	var changes []bool
+	wg.SetHealthListener(func(healthy bool) {
+		changes = append(changes, healthy)
+	})
+
+	checks := []bool{false, true, true, false, false, false, false, true}
+	for _, ok := range checks {
+		wg.recordHealthCheck(ok)
+	}
+
+	want := []bool{true, false, true}
+	if !slices.Equal(changes, want) {
+		t.Errorf("health changes = %v, want %v", changes, want)
+	}
+	if !wg.Healthy() {
+		t.Error("expected the tunnel to be healthy after a passing check")
+	}
+}